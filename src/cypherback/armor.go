@@ -0,0 +1,268 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+
+Armoured format
+
+-----BEGIN CYPHERBACK KIND-----
+Header: value
+...
+Checksum: hex of the first 128 bits of SHA-384(data)
+
+base64 of 48 bytes of data, space, line checksum
+...
+-----END CYPHERBACK KIND-----
+
+Each line checksum is the low 16 bits of the CRC-32 of the line
+number (starting at one, as a 4-byte big-endian integer) followed by
+the line's decoded bytes, as four hex digits.  Line checksums make it
+possible to find a mistyped line when restoring from paper.
+
+Armoured secrets files (KIND "SECRETS") carry the headers Id, Label
+(if the secrets file has one) and, optionally, Fingerprint.
+
+*/
+
+const armorLineBytes = 48
+
+func armorBegin(kind string) string {
+	return "-----BEGIN CYPHERBACK " + kind + "-----"
+}
+
+func armorEnd(kind string) string {
+	return "-----END CYPHERBACK " + kind + "-----"
+}
+
+func armorLineChecksum(lineNumber int, data []byte) string {
+	crc := crc32.NewIEEE()
+	binary.Write(crc, binary.BigEndian, uint32(lineNumber))
+	crc.Write(data)
+	return fmt.Sprintf("%04x", crc.Sum32()&0xffff)
+}
+
+func armorChecksum(data []byte) string {
+	digester := sha512.New384()
+	digester.Write(data)
+	return hex.EncodeToString(digester.Sum(nil)[:16])
+}
+
+// Fingerprint formats the first 160 bits of the hex secrets ID ID
+// as groups of four digits, for comparison by eye.
+func Fingerprint(id string) string {
+	if len(id) > 40 {
+		id = id[:40]
+	}
+	var groups []string
+	for len(id) > 4 {
+		groups = append(groups, id[:4])
+		id = id[4:]
+	}
+	groups = append(groups, id)
+	return strings.ToUpper(strings.Join(groups, " "))
+}
+
+// writeArmor writes DATA to W as an ASCII-armoured block of type KIND
+// with HEADERS, each a name and value, followed by a checksum.
+func writeArmor(w io.Writer, kind string, headers [][2]string, data []byte) error {
+	writer := bufio.NewWriter(w)
+	fmt.Fprintln(writer, armorBegin(kind))
+	for _, header := range headers {
+		fmt.Fprintf(writer, "%s: %s\n", header[0], header[1])
+	}
+	fmt.Fprintf(writer, "Checksum: %s\n", armorChecksum(data))
+	fmt.Fprintln(writer)
+	for i := 0; i*armorLineBytes < len(data); i++ {
+		end := (i + 1) * armorLineBytes
+		if end > len(data) {
+			end = len(data)
+		}
+		line := data[i*armorLineBytes : end]
+		fmt.Fprintf(writer, "%s %s\n", base64.StdEncoding.EncodeToString(line), armorLineChecksum(i+1, line))
+	}
+	fmt.Fprintln(writer, armorEnd(kind))
+	return writer.Flush()
+}
+
+// readArmor reads the next ASCII-armoured block of type KIND from
+// SCANNER, checking every line checksum and the overall checksum.
+// Text outside blocks is ignored; io.EOF is returned if there are no
+// more blocks.
+func readArmor(scanner *bufio.Scanner, kind string) (data []byte, headers map[string]string, err error) {
+	headers = make(map[string]string)
+	state := 0 // 0: before begin; 1: headers; 2: data; 3: after end
+	lineNumber := 0
+	for state != 3 && scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch state {
+		case 0:
+			if line == armorBegin(kind) {
+				state = 1
+			}
+		case 1:
+			if line == "" {
+				state = 2
+				continue
+			}
+			fields := strings.SplitN(line, ":", 2)
+			if len(fields) != 2 {
+				return nil, nil, fmt.Errorf("Malformed armour header %q", line)
+			}
+			headers[fields[0]] = strings.TrimSpace(fields[1])
+		case 2:
+			if line == "" {
+				continue
+			}
+			if line == armorEnd(kind) {
+				state = 3
+				continue
+			}
+			lineNumber++
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return nil, nil, fmt.Errorf("Malformed armour on line %d of data", lineNumber)
+			}
+			lineData, err := base64.StdEncoding.DecodeString(fields[0])
+			if err != nil {
+				return nil, nil, fmt.Errorf("Bad base64 on line %d of data: %v", lineNumber, err)
+			}
+			if !strings.EqualFold(fields[1], armorLineChecksum(lineNumber, lineData)) {
+				return nil, nil, fmt.Errorf("Checksum error on line %d of data", lineNumber)
+			}
+			data = append(data, lineData...)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+	switch state {
+	case 0:
+		return nil, nil, io.EOF
+	case 1, 2:
+		return nil, nil, fmt.Errorf("Incomplete armoured %s", strings.ToLower(kind))
+	}
+	if !strings.EqualFold(headers["Checksum"], armorChecksum(data)) {
+		return nil, nil, fmt.Errorf("Armoured %s checksum does not match", strings.ToLower(kind))
+	}
+	return data, headers, nil
+}
+
+// armorSecrets writes the encrypted secrets file ENCSECRETS, stored
+// under ID, to W as ASCII-armoured text.
+func armorSecrets(w io.Writer, id string, encSecrets []byte, fingerprint bool) error {
+	header, err := readSecretsHeader(encSecrets)
+	if err != nil {
+		return err
+	}
+	headers := [][2]string{{"Id", id}}
+	if header.label != "" {
+		headers = append(headers, [2]string{"Label", header.label})
+	}
+	if fingerprint {
+		headers = append(headers, [2]string{"Fingerprint", Fingerprint(id)})
+	}
+	return writeArmor(w, "SECRETS", headers, encSecrets)
+}
+
+// dearmorSecrets reads an ASCII-armoured secrets file from R.
+func dearmorSecrets(r io.Reader) (encSecrets []byte, headers map[string]string, err error) {
+	encSecrets, headers, err = readArmor(bufio.NewScanner(r), "SECRETS")
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("No armoured secrets found")
+	}
+	return encSecrets, headers, err
+}
+
+// ExportSecrets writes the secrets file ID, or the default secrets
+// file if ID is empty, to W as ASCII-armoured text suitable for
+// printing or offline storage.  The keys remain encrypted under the
+// passphrase.
+func ExportSecrets(backend Backend, id string, w io.Writer, fingerprint bool) (err error) {
+	if id == "" {
+		id, err = backend.DefaultSecretsId()
+		if err != nil {
+			return err
+		}
+	}
+	encSecrets, err := backend.ReadSecretsById(id)
+	if err != nil {
+		return err
+	}
+	return armorSecrets(w, id, encSecrets, fingerprint)
+}
+
+// ImportSecrets reads ASCII-armoured secrets written by ExportSecrets
+// from R, prompts for the passphrase in order to validate them, and
+// installs them in BACKEND.
+func ImportSecrets(backend Backend, r io.Reader) (secrets *Secrets, err error) {
+	encSecrets, headers, err := dearmorSecrets(r)
+	if err != nil {
+		return nil, err
+	}
+	if id, ok := headers["Id"]; ok {
+		fmt.Fprintf(os.Stderr, "Importing secrets %s\n", id)
+	}
+	passphrase := readPassphrase("Enter passphrase: ")
+	defer passphrase.wipe()
+	return importSecrets(backend, encSecrets, headers, passphrase)
+}
+
+func importSecrets(backend Backend, encSecrets []byte, headers map[string]string, passphrase []byte) (secrets *Secrets, err error) {
+	secrets, _, err = decodeSecrets(encSecrets, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	id := secrets.HexId()
+	if headerId, ok := headers["Id"]; ok && headerId != id {
+		ZeroSecrets(secrets)
+		return nil, fmt.Errorf("Armoured secrets claim to be %s but are %s", headerId, id)
+	}
+	if fingerprint, ok := headers["Fingerprint"]; ok && fingerprint != Fingerprint(id) {
+		ZeroSecrets(secrets)
+		return nil, fmt.Errorf("Armoured secrets fingerprint %s does not match %s", fingerprint, Fingerprint(id))
+	}
+	// the secrets file is written exactly as exported, so that its
+	// KDF and label are unchanged
+	err = backend.WriteSecrets(id, encSecrets)
+	if err != nil {
+		ZeroSecrets(secrets)
+		return nil, err
+	}
+	// importing an older copy is deliberate, not a rollback
+	err = generationCache.accept(id, secretsFileId, secrets.generation)
+	if err != nil {
+		ZeroSecrets(secrets)
+		return nil, err
+	}
+	return secrets, nil
+}
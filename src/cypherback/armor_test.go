@@ -0,0 +1,92 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	memoryBackend "cypherback/backends/memory"
+	"strings"
+	"testing"
+)
+
+func TestArmorSecrets(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets.label = "paper"
+	encSecrets, err := encodeSecrets(secrets, []byte("passphrase"), pbkdf2KDF{iterations: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := memoryBackend.New()
+	err = backend.WriteSecrets(secrets.HexId(), encSecrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored := &bytes.Buffer{}
+	err = ExportSecrets(backend, "", armored, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := armored.String()
+	if !strings.Contains(text, "Fingerprint: "+Fingerprint(secrets.HexId())) {
+		t.Error("No fingerprint in", text)
+	}
+
+	dearmored, headers, err := dearmorSecrets(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dearmored, encSecrets) {
+		t.Fatal("Dearmoured secrets differ")
+	}
+	otherBackend := memoryBackend.New()
+	imported, err := importSecrets(otherBackend, dearmored, headers, []byte("passphrase"))
+	defer ZeroSecrets(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := otherBackend.ReadSecretsById(secrets.HexId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, encSecrets) {
+		t.Error("Imported secrets differ")
+	}
+
+	// corrupt one character of the first data line
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line == "" {
+			data := []byte(lines[i+1])
+			if data[0] == 'A' {
+				data[0] = 'B'
+			} else {
+				data[0] = 'A'
+			}
+			lines[i+1] = string(data)
+			break
+		}
+	}
+	_, _, err = dearmorSecrets(strings.NewReader(strings.Join(lines, "\n")))
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Error("Corruption not detected on line 1:", err)
+	}
+}
@@ -18,10 +18,34 @@
 package cypherback
 
 type Backend interface {
+	// WriteSecrets stores a secrets file under ID, making it the
+	// default if there is no default yet
 	WriteSecrets(id string, encSecrets []byte) error
+	// ReadSecrets reads the default secrets file
 	ReadSecrets() ([]byte, error)
+	ReadSecretsById(id string) ([]byte, error)
+	ListSecrets() (ids []string, err error)
+	DefaultSecretsId() (string, error)
+	SetDefaultSecrets(id string) error
+	// DeleteSecrets removes the secrets file ID, which must not be
+	// the default
+	DeleteSecrets(id string) error
 	WriteBackupSet(secretsId, id string, data []byte) error
+	// ReadBackupSet reads the backup set ID; if there is no such
+	// set, the error satisfies os.IsNotExist
 	ReadBackupSet(secretsId, id string) (data []byte, err error)
+	ListBackupSets(secretsId string) (ids []string, err error)
+	DeleteBackupSet(secretsId, id string) error
 	WriteChunk(secretsId, id string, data []byte) error
 	ReadChunk(secretsId, id string) (date []byte, err error)
+	ListChunks(secretsId string) (ids []string, err error)
+	DeleteChunk(secretsId, id string) error
+}
+
+// A BackupSetAppender is a Backend which can update a backup set in
+// place, so that appending to a set needn't rewrite all of it.
+// AppendBackupSet replaces everything from OFFSET onwards in the
+// backup set ID with DATA.
+type BackupSetAppender interface {
+	AppendBackupSet(secretsId, id string, offset int64, data []byte) error
 }
@@ -22,6 +22,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type FileBackend struct {
@@ -32,22 +33,34 @@ func (fb *FileBackend) WriteSecrets(id string, encSecrets []byte) (err error) {
 	path := filepath.Join(fb.path, id)
 	err = os.MkdirAll(path, os.ModePerm)
 	if err != nil {
-		return nil
+		return err
 	}
-	path = filepath.Join(path, "secrets")
-	file, err := os.Create(path)
+	// write to a temporary file and atomically overwrite the
+	// original, so that an existing secrets file is never lost
+	file, err := ioutil.TempFile(path, "secrets")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	// FIXME: write to a temporary file and atomically overwrite original
 	n, err := file.Write(encSecrets)
+	if err == nil && n != len(encSecrets) {
+		err = fmt.Errorf("Did not write all %d bytes, but only %d", len(encSecrets), n)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(file.Name())
 		return err
 	}
-	if n != len(encSecrets) {
-		return fmt.Errorf("Did not write all %d bytes, but only %d", len(encSecrets), n)
+	path = filepath.Join(path, "secrets")
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		os.Remove(file.Name())
+		return err
 	}
 	// if there isn't a default secrets file, create a symlink to this one
 	defaultPath := filepath.Join(fb.path, "defaultSecrets")
@@ -72,6 +85,93 @@ func (fb *FileBackend) ReadSecrets() (encSecrets []byte, err error) {
 	return ioutil.ReadAll(file)
 }
 
+func (fb *FileBackend) ReadSecretsById(id string) (encSecrets []byte, err error) {
+	path := filepath.Join(fb.path, id, "secrets")
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+func (fb *FileBackend) ListSecrets() (ids []string, err error) {
+	infos, err := ioutil.ReadDir(fb.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		_, err = os.Stat(filepath.Join(fb.path, info.Name(), "secrets"))
+		if err == nil {
+			ids = append(ids, info.Name())
+		}
+	}
+	return ids, nil
+}
+
+func (fb *FileBackend) DefaultSecretsId() (string, error) {
+	target, err := os.Readlink(filepath.Join(fb.path, "defaultSecrets"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(filepath.Dir(target)), nil
+}
+
+func (fb *FileBackend) SetDefaultSecrets(id string) error {
+	path := filepath.Join(fb.path, id, "secrets")
+	_, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// replace the symlink atomically
+	defaultPath := filepath.Join(fb.path, "defaultSecrets")
+	tempPath := defaultPath + ".new"
+	os.Remove(tempPath)
+	err = os.Symlink(path, tempPath)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, defaultPath)
+}
+
+func (fb *FileBackend) DeleteSecrets(id string) error {
+	defaultId, err := fb.DefaultSecretsId()
+	if err == nil && defaultId == id {
+		return fmt.Errorf("Cannot delete the default secrets")
+	}
+	err = os.Remove(filepath.Join(fb.path, id, "secrets"))
+	if err != nil {
+		return err
+	}
+	// clean up, if the directories are now empty
+	os.Remove(filepath.Join(fb.path, id, "sets"))
+	os.Remove(filepath.Join(fb.path, id, "chunks"))
+	os.Remove(filepath.Join(fb.path, id))
+	return nil
+}
+
+// listDir returns the names of the files in PATH, which need not exist
+func listDir(path string) (names []string, err error) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, info := range infos {
+		// skip files left half-written
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
+
 func NewFileBackend(path string) *FileBackend {
 	return &FileBackend{path: path}
 }
@@ -89,18 +189,13 @@ func (fb *FileBackend) WriteBackupSet(secretsId, id string, data []byte) (err er
 	if !info.IsDir() {
 		return fmt.Errorf("%s is not a directory", path)
 	}
-	path = filepath.Join(path, id)
-	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	// the set is written beside its old version and then renamed
+	// over it, so that readers see either one or the other
+	file, err := ioutil.TempFile(path, "."+id)
 	if err != nil {
-		if os.IsNotExist(err) {
-			file, err = os.Create(path)
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
+		return err
 	}
+	defer os.Remove(file.Name())
 	defer file.Close()
 
 	n, err := file.Write(data)
@@ -110,7 +205,39 @@ func (fb *FileBackend) WriteBackupSet(secretsId, id string, data []byte) (err er
 	if err != nil {
 		return err
 	}
-	return nil
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(path, id))
+}
+
+func (fb *FileBackend) AppendBackupSet(secretsId, id string, offset int64, data []byte) error {
+	path := filepath.Join(fb.path, secretsId, "sets", id)
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if offset > info.Size() {
+		return fmt.Errorf("Cannot append at %d to a backup set of %d bytes", offset, info.Size())
+	}
+	n, err := file.WriteAt(data, offset)
+	if n != len(data) {
+		return fmt.Errorf("Couldn't write all data: wrote %d but had %d", n, len(data))
+	}
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(offset + int64(len(data)))
+	if err != nil {
+		return err
+	}
+	return file.Sync()
 }
 
 func (fb *FileBackend) ReadBackupSet(secretsId, id string) (data []byte, err error) {
@@ -126,6 +253,14 @@ func (fb *FileBackend) ReadBackupSet(secretsId, id string) (data []byte, err err
 	return data, nil
 }
 
+func (fb *FileBackend) ListBackupSets(secretsId string) (ids []string, err error) {
+	return listDir(filepath.Join(fb.path, secretsId, "sets"))
+}
+
+func (fb *FileBackend) DeleteBackupSet(secretsId, id string) error {
+	return os.Remove(filepath.Join(fb.path, secretsId, "sets", id))
+}
+
 func (fb *FileBackend) WriteChunk(secretsId, id string, data []byte) error {
 	path := filepath.Join(fb.path, secretsId, "chunks")
 	err := os.MkdirAll(path, os.ModePerm)
@@ -170,3 +305,11 @@ func (fb *FileBackend) ReadChunk(secretsId, id string) ([]byte, error) {
 	}
 	return data, nil
 }
+
+func (fb *FileBackend) ListChunks(secretsId string) (ids []string, err error) {
+	return listDir(filepath.Join(fb.path, secretsId, "chunks"))
+}
+
+func (fb *FileBackend) DeleteChunk(secretsId, id string) error {
+	return os.Remove(filepath.Join(fb.path, secretsId, "chunks", id))
+}
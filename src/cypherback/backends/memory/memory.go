@@ -19,11 +19,14 @@ package memory
 
 import (
 	"fmt"
+	"os"
+	"sort"
+	"strings"
 )
 
 type MemoryBackend struct {
 	secrets        map[string][]byte
-	defaultSecrets []byte
+	defaultSecrets string
 	backupSets     map[string][]byte
 	chunks         map[string][]byte
 }
@@ -37,41 +40,124 @@ func New() *MemoryBackend {
 
 func (mb *MemoryBackend) WriteSecrets(id string, encSecrets []byte) (err error) {
 	mb.secrets[id] = encSecrets
-	if mb.defaultSecrets == nil {
-		mb.defaultSecrets = encSecrets
+	if mb.defaultSecrets == "" {
+		mb.defaultSecrets = id
 	}
 	return nil
 }
 
 func (mb *MemoryBackend) ReadSecrets() (encSecrets []byte, err error) {
-	if mb.defaultSecrets != nil {
-		return mb.defaultSecrets, nil
+	if mb.defaultSecrets != "" {
+		return mb.secrets[mb.defaultSecrets], nil
 	}
 	return nil, fmt.Errorf("No default")
 }
 
+func (mb *MemoryBackend) ReadSecretsById(id string) (encSecrets []byte, err error) {
+	encSecrets, ok := mb.secrets[id]
+	if ok {
+		return encSecrets, nil
+	}
+	return nil, fmt.Errorf("Could not retrieve secrets %s", id)
+}
+
+func (mb *MemoryBackend) ListSecrets() (ids []string, err error) {
+	for id := range mb.secrets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (mb *MemoryBackend) DefaultSecretsId() (string, error) {
+	if mb.defaultSecrets != "" {
+		return mb.defaultSecrets, nil
+	}
+	return "", fmt.Errorf("No default")
+}
+
+func (mb *MemoryBackend) SetDefaultSecrets(id string) error {
+	if _, ok := mb.secrets[id]; !ok {
+		return fmt.Errorf("No such secrets %s", id)
+	}
+	mb.defaultSecrets = id
+	return nil
+}
+
+func (mb *MemoryBackend) DeleteSecrets(id string) error {
+	if id == mb.defaultSecrets {
+		return fmt.Errorf("Cannot delete the default secrets")
+	}
+	delete(mb.secrets, id)
+	return nil
+}
+
+// listIds returns the IDs of all items in STORE belonging to SECRETSID
+func listIds(store map[string][]byte, secretsId string) (ids []string) {
+	prefix := secretsId + "/"
+	for key := range store {
+		if strings.HasPrefix(key, prefix) {
+			ids = append(ids, key[len(prefix):])
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
 func (mb *MemoryBackend) WriteBackupSet(secretsId, id string, data []byte) (err error) {
-	mb.backupSets[id] = data
+	mb.backupSets[secretsId+"/"+id] = data
 	return nil
 }
 
 func (mb *MemoryBackend) ReadBackupSet(secretsId, id string) (data []byte, err error) {
-	data, ok := mb.backupSets[id]
+	data, ok := mb.backupSets[secretsId+"/"+id]
 	if ok {
 		return data, nil
 	}
-	return nil, fmt.Errorf("Could not retrieve backup set")
+	return nil, &os.PathError{Op: "read", Path: secretsId + "/" + id, Err: os.ErrNotExist}
+}
+
+func (mb *MemoryBackend) AppendBackupSet(secretsId, id string, offset int64, data []byte) error {
+	existing, ok := mb.backupSets[secretsId+"/"+id]
+	if !ok {
+		return fmt.Errorf("Could not retrieve backup set")
+	}
+	if offset > int64(len(existing)) {
+		return fmt.Errorf("Cannot append at %d to a backup set of %d bytes", offset, len(existing))
+	}
+	updated := make([]byte, offset, offset+int64(len(data)))
+	copy(updated, existing)
+	mb.backupSets[secretsId+"/"+id] = append(updated, data...)
+	return nil
+}
+
+func (mb *MemoryBackend) ListBackupSets(secretsId string) (ids []string, err error) {
+	return listIds(mb.backupSets, secretsId), nil
+}
+
+func (mb *MemoryBackend) DeleteBackupSet(secretsId, id string) error {
+	delete(mb.backupSets, secretsId+"/"+id)
+	return nil
 }
 
 func (mb *MemoryBackend) WriteChunk(secretsId, id string, data []byte) error {
-	mb.chunks[id] = data
+	mb.chunks[secretsId+"/"+id] = data
 	return nil
 }
 
 func (mb *MemoryBackend) ReadChunk(secretsId, id string) ([]byte, error) {
-	data, ok := mb.chunks[id]
+	data, ok := mb.chunks[secretsId+"/"+id]
 	if ok {
 		return data, nil
 	}
 	return nil, fmt.Errorf("Could not retrieve chunk")
 }
+
+func (mb *MemoryBackend) ListChunks(secretsId string) (ids []string, err error) {
+	return listIds(mb.chunks, secretsId), nil
+}
+
+func (mb *MemoryBackend) DeleteChunk(secretsId, id string) error {
+	delete(mb.chunks, secretsId+"/"+id)
+	return nil
+}
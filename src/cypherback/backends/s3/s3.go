@@ -1,8 +1,11 @@
 package s3
 
 import (
-	"launchpad.net/goamz/s3"
+	"fmt"
 	"launchpad.net/goamz/aws"
+	"launchpad.net/goamz/s3"
+	"os"
+	"strings"
 )
 
 type S3 struct {
@@ -37,13 +40,106 @@ func (s *S3) ReadSecrets() (encSecrets []byte, err error) {
 	return s.bucket.Get(string(id) + "/secrets")
 }
 
+func (s *S3) ReadSecretsById(id string) (encSecrets []byte, err error) {
+	return s.bucket.Get(id + "/secrets")
+}
+
+func (s *S3) ListSecrets() (ids []string, err error) {
+	marker := ""
+	for {
+		resp, err := s.bucket.List("", "/", marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range resp.CommonPrefixes {
+			id := strings.TrimSuffix(prefix, "/")
+			secrets, err := s.bucket.List(id+"/secrets", "/", "", 1)
+			if err != nil {
+				return nil, err
+			}
+			if len(secrets.Contents) != 0 {
+				ids = append(ids, id)
+			}
+			marker = prefix
+		}
+		for _, key := range resp.Contents {
+			if key.Key > marker {
+				marker = key.Key
+			}
+		}
+		if !resp.IsTruncated {
+			break
+		}
+	}
+	return ids, nil
+}
+
+func (s *S3) DefaultSecretsId() (string, error) {
+	id, err := s.bucket.Get("defaultSecrets")
+	if err != nil {
+		return "", err
+	}
+	return string(id), nil
+}
+
+func (s *S3) SetDefaultSecrets(id string) error {
+	resp, err := s.bucket.List(id+"/secrets", "/", "", 1)
+	if err != nil {
+		return err
+	}
+	if len(resp.Contents) == 0 {
+		return fmt.Errorf("No such secrets %s", id)
+	}
+	return s.bucket.Put("defaultSecrets", []byte(id), "application/vnd.cypherback.secretsid", "")
+}
+
+func (s *S3) DeleteSecrets(id string) error {
+	defaultId, err := s.DefaultSecretsId()
+	if err == nil && defaultId == id {
+		return fmt.Errorf("Cannot delete the default secrets")
+	}
+	return s.bucket.Del(id + "/secrets")
+}
+
+// listKeys returns every key beginning with PREFIX, with PREFIX removed
+func (s *S3) listKeys(prefix string) (keys []string, err error) {
+	marker := ""
+	for {
+		resp, err := s.bucket.List(prefix, "", marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range resp.Contents {
+			keys = append(keys, strings.TrimPrefix(key.Key, prefix))
+			marker = key.Key
+		}
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			break
+		}
+	}
+	return keys, nil
+}
+
 func (s *S3) WriteBackupSet(secretsId, id string, data []byte) error {
 	path := secretsId + "/sets/" + id
 	return s.bucket.Put(path, data, "application/vnd.cypherback.backupset", "")
 }
 
-func (s *S3) ReadBackupSet(secretsId, id string) (data []byte, err error) { 
-	return s.bucket.Get(secretsId + "/sets/" + id)
+func (s *S3) ReadBackupSet(secretsId, id string) (data []byte, err error) {
+	path := secretsId + "/sets/" + id
+	data, err = s.bucket.Get(path)
+	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
+		return nil, &os.PathError{Op: "get", Path: path, Err: os.ErrNotExist}
+	}
+	return data, err
+}
+
+func (s *S3) ListBackupSets(secretsId string) (ids []string, err error) {
+	return s.listKeys(secretsId + "/sets/")
+}
+
+func (s *S3) DeleteBackupSet(secretsId, id string) error {
+	return s.bucket.Del(secretsId + "/sets/" + id)
 }
 
 func chunkIdToPath(secretsId, id string) string {
@@ -58,6 +154,21 @@ func (s *S3) ReadChunk(secretsId, id string) (date []byte, err error) {
 	return s.bucket.Get(chunkIdToPath(secretsId, id))
 }
 
+func (s *S3) ListChunks(secretsId string) (ids []string, err error) {
+	paths, err := s.listKeys(secretsId + "/chunks/")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		ids = append(ids, path[strings.LastIndex(path, "/")+1:])
+	}
+	return ids, nil
+}
+
+func (s *S3) DeleteChunk(secretsId, id string) error {
+	return s.bucket.Del(chunkIdToPath(secretsId, id))
+}
+
 func New(access, secret, endpoint, bucketName string) (s3Backend *S3, err error) {
 	s3Conn := s3.New(aws.Auth{access, secret}, aws.Region{S3Endpoint: endpoint})
 	bucket := s3Conn.Bucket(bucketName)
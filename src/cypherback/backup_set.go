@@ -21,7 +21,6 @@ package cypherback
 
 import (
 	"bytes"
-	"compress/lzw"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
@@ -52,63 +51,122 @@ type BackupSet struct {
 	seenChunks     map[string]bool
 	tempDir        string
 	lastStartIndex int
+	compression    compression
+	padding        padding
+	xattrFilter    xattrFilter
+	// which files to skip, and the patterns given as options; see
+	// exclude.go
+	excludeOptions ExcludeOptions
+	excludeRules   []ignoreFile
+	// the files which could not be backed up in the current run;
+	// see file_errors.go
+	fileErrors []*FileError
+	// the index of runs which have been stored
+	runs []runInfo
+	// how many records have been stored in runs
+	encodedRecords int
+	// the index as last read or written, if it can be appended to,
+	// and how many runs and segments it holds
+	encoded     []byte
+	encodedRuns int
+	segments    uint32
+	// the generation of the index, increased by each write of it
+	generation uint64
 }
 
 func newBackupSet(tag string, secrets *Secrets) (backupSet *BackupSet, err error) {
-	backupSet = &BackupSet{tag: tag, secrets: secrets}
+	backupSet = &BackupSet{tag: tag, secrets: secrets, compression: compressAuto, padding: padRandom}
 	backupSet.hardLinks = make(map[devInode]string)
 	backupSet.seenChunks = make(map[string]bool)
-	backupSet.tempDir, err = ioutil.TempDir("/tmp/", "cypherback")
+	return backupSet, nil
+}
+
+// SetCompression selects how chunks written from now on are
+// compressed: "none", "lzw", "deflate" (or "gzip"), or "auto", the
+// default, which uses DEFLATE but stores chunks which do not shrink
+// uncompressed.
+func (b *BackupSet) SetCompression(name string) error {
+	method, err := parseCompression(name)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return backupSet, nil
+	b.compression = method
+	return nil
+}
+
+// SetPadding selects how chunks and the backup set are padded to hide
+// their exact sizes: "none"; "random", the default, which adds up to
+// 255 bytes; or "pow2", which pads to the next power of two, hiding
+// more at a greater cost in storage.
+func (b *BackupSet) SetPadding(name string) error {
+	scheme, err := parsePadding(name)
+	if err != nil {
+		return err
+	}
+	b.padding = scheme
+	return nil
+}
+
+// ensureTempDir creates the directory in which new chunks are held
+// until they are written, if it does not yet exist; sets which are
+// only read never need one
+func (b *BackupSet) ensureTempDir() (err error) {
+	if b.tempDir == "" {
+		b.tempDir, err = ioutil.TempDir("/tmp/", "cypherback")
+	}
+	return err
 }
 
 type readChunk func(string) ([]byte, error)
 
 type fileRecord interface {
-	Record() (recordType uint8, data []byte)
-	Len() uint32
-	Restore(readChunk) error
+	Record() (recordType uint8, data []byte, err error)
+	Len() uint64
+	Restore(*restorer) error
 }
 
 type startRecord struct {
 	date   time.Time
-	length uint32
+	length uint64
 }
 
-func readStartRecord(reader io.Reader) (fileRecord, error) {
+// readStartRecord reads a start record of record VERSION, whose run
+// length is 64 bits wide from wideRecordVersion on
+func readStartRecord(reader io.Reader, version uint8) (fileRecord, error) {
 	var seconds int64
-	var length uint32
 	err := binary.Read(reader, binary.BigEndian, &seconds)
 	if err != nil {
 		return nil, err
 	}
-	err = binary.Read(reader, binary.BigEndian, &length)
+	r := startRecord{date: time.Unix(seconds, 0)}
+	if version >= wideRecordVersion {
+		err = binary.Read(reader, binary.BigEndian, &r.length)
+	} else {
+		var length uint32
+		err = binary.Read(reader, binary.BigEndian, &length)
+		r.length = uint64(length)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return startRecord{date: time.Unix(seconds, 0), length: length}, nil
+	return r, nil
 }
 
-func (r startRecord) Record() (recordType uint8, data []byte) {
+func (r startRecord) Record() (recordType uint8, data []byte, err error) {
 	writer := &bytes.Buffer{}
 	binary.Write(writer, binary.BigEndian, r.date.Unix())
 	binary.Write(writer, binary.BigEndian, r.length)
-	return 0, writer.Bytes()
+	return 0, writer.Bytes(), nil
 }
 
-func (r startRecord) Len() uint32 {
-	return 2 + 8 + 4
+func (r startRecord) Len() uint64 {
+	return 2 + 8 + 8
 }
 
-func (r startRecord) Restore(readChunk) error {
+func (r startRecord) Restore(*restorer) error {
 	return nil
 }
 
-// FIXME: handle extended attributes
-
 type baseFileInfo struct {
 	name      string
 	mode      os.FileMode
@@ -119,9 +177,10 @@ type baseFileInfo struct {
 	aTime     time.Time
 	mTime     time.Time
 	cTime     time.Time
+	xattrs    []xattr // see xattr.go
 }
 
-func (r baseFileInfo) Record() []byte {
+func (r baseFileInfo) Record() ([]byte, error) {
 	writer := &bytes.Buffer{}
 	binary.Write(writer, binary.BigEndian, int64(r.mode))
 	binary.Write(writer, binary.BigEndian, int64(r.uid))
@@ -129,13 +188,19 @@ func (r baseFileInfo) Record() []byte {
 	binary.Write(writer, binary.BigEndian, int64(r.aTime.UnixNano()))
 	binary.Write(writer, binary.BigEndian, int64(r.mTime.UnixNano()))
 	binary.Write(writer, binary.BigEndian, int64(r.cTime.UnixNano()))
-	binary.Write(writer, binary.BigEndian, int32(len(r.name)))
-	writer.Write([]byte(r.name))
-	binary.Write(writer, binary.BigEndian, int32(len(r.userName)))
-	writer.Write([]byte(r.userName))
-	binary.Write(writer, binary.BigEndian, int32(len(r.groupName)))
-	writer.Write([]byte(r.groupName))
-	return writer.Bytes()
+	err := writeLenString(writer, "name", r.name)
+	if err != nil {
+		return nil, err
+	}
+	err = writeLenString(writer, "username", r.userName)
+	if err != nil {
+		return nil, err
+	}
+	err = writeLenString(writer, "groupname", r.groupName)
+	if err != nil {
+		return nil, err
+	}
+	return writer.Bytes(), nil
 }
 
 func readBaseFileInfo(reader io.Reader) (b baseFileInfo, err error) {
@@ -195,119 +260,155 @@ func readBaseFileInfo(reader io.Reader) (b baseFileInfo, err error) {
 	return b, err
 }
 
-// FIXME: need to check for _each_ Len that it does not exceed math.MaxUint32
-
-func (r baseFileInfo) Len() uint32 {
-	if len(r.name) > math.MaxUint32 {
-		panic(fmt.Errorf("Record name length > %d", math.MaxUint32))
-	}
-	if len(r.userName) > math.MaxUint32 {
-		panic(fmt.Errorf("Record username length > %d", math.MaxUint32))
-	}
-	if len(r.groupName) > math.MaxUint32 {
-		panic(fmt.Errorf("Record groupname length > %d", math.MaxUint32))
-	}
-	return 8 + 8 + 8 + 8 + 8 + 8 + 4 + uint32(len(r.name)) + 4 + uint32(len(r.userName)) + 4 + uint32(len(r.groupName))
+func (r baseFileInfo) Len() uint64 {
+	return 8 + 8 + 8 + 8 + 8 + 8 + 4 + uint64(len(r.name)) + 4 + uint64(len(r.userName)) + 4 + uint64(len(r.groupName)) + xattrsLen(r.xattrs)
 }
 
-func (r baseFileInfo) Restore() (err error) {
-	err = os.Chmod(r.name, r.mode)
-	if err != nil {
-		return nil
-	}
-	// FIXME: get chown working
-	err = os.Chtimes(r.name, r.aTime, r.mTime)
-	return nil
+// Restore restores the file's owner, attributes, mode and times,
+// reporting each failure.  The owner goes first, since changing it
+// clears set-ID bits and file capabilities, and ACLs before the mode,
+// which then sets their mask.
+func (r baseFileInfo) Restore(restorer *restorer) error {
+	errs := []error{restorer.restoreOwner(r)}
+	errs = append(errs, restoreXattrs(r.name, r.xattrs)...)
+	errs = append(errs, os.Chmod(r.name, r.mode))
+	errs = append(errs, os.Chtimes(r.name, r.aTime, r.mTime))
+	return restorer.report(r.name, errs...)
 }
 
 type regularFileInfo struct {
 	baseFileInfo
 	size   int64
 	chunks []string // FIXME: should be a [][]byte for efficiency
+	// the data extents of a sparse file, or nil; see sparse.go
+	extents []extent
 }
 
-func readRegularFile(reader io.Reader) (fileRecord, error) {
+func readRegularFile(reader io.Reader, version uint8) (fileRecord, error) {
+	return readFile(reader, false, version)
+}
+
+// readFile reads a regular file record of record VERSION, which if
+// SPARSE maps the file's data extents before its chunks.  Chunk
+// counts are 64 bits wide and chunk IDs binary from wideRecordVersion
+// on; before, counts were 32 bits wide and IDs hex.
+func readFile(reader io.Reader, sparse bool, version uint8) (fileRecord, error) {
 	baseInfo, err := readBaseFileInfo(reader)
 	if err != nil {
 		return nil, err
 	}
-	r := regularFileInfo{baseInfo, 0, nil}
+	r := regularFileInfo{baseFileInfo: baseInfo}
 	err = binary.Read(reader, binary.BigEndian, &r.size)
 	if err != nil {
 		return nil, err
 	}
-	var numChunks uint32
+	if sparse {
+		r.extents, err = readExtents(reader, version)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if version < wideRecordVersion {
+		var numChunks uint32
+		err = binary.Read(reader, binary.BigEndian, &numChunks)
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < numChunks; i++ {
+			chunk, err := readLenString(reader, 96)
+			if err != nil {
+				return nil, err
+			}
+			r.chunks = append(r.chunks, chunk)
+		}
+		return r, nil
+	}
+	var numChunks uint64
 	err = binary.Read(reader, binary.BigEndian, &numChunks)
-	for i := 0; i < int(numChunks); i++ {
-		chunk, err := readLenString(reader, 96)
+	if err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, chunkIdLength)
+	for i := uint64(0); i < numChunks; i++ {
+		_, err = io.ReadFull(reader, chunk)
 		if err != nil {
 			return nil, err
 		}
-		r.chunks = append(r.chunks, chunk)
+		r.chunks = append(r.chunks, hex.EncodeToString(chunk))
 	}
 	return r, nil
 }
 
-func (r regularFileInfo) Record() (uint8, []byte) {
+// chunkIdLength is the length of a binary chunk ID, a SHA-384
+const chunkIdLength = sha512.Size384
+
+func (r regularFileInfo) Record() (uint8, []byte, error) {
 	writer := &bytes.Buffer{}
-	writer.Write(r.baseFileInfo.Record())
+	base, err := r.baseFileInfo.Record()
+	if err != nil {
+		return 0, nil, err
+	}
+	writer.Write(base)
 	binary.Write(writer, binary.BigEndian, r.size)
-	binary.Write(writer, binary.BigEndian, uint32(len(r.chunks)))
+	if r.extents != nil {
+		writeExtents(writer, r.extents)
+	}
+	binary.Write(writer, binary.BigEndian, uint64(len(r.chunks)))
 	for _, chunk := range r.chunks {
-		writer.Write([]byte(chunk))
+		id, err := hex.DecodeString(chunk)
+		if err != nil || len(id) != chunkIdLength {
+			return 0, nil, fmt.Errorf("Invalid chunk ID %q in record of %s", chunk, r.name)
+		}
+		writer.Write(id)
 	}
-	return 3, writer.Bytes()
+	if r.extents != nil {
+		return 9, writer.Bytes(), nil
+	}
+	return 3, writer.Bytes(), nil
 }
 
-func (r regularFileInfo) Len() uint32 {
-	// FIXME: is this a practical max number of chunks?
-	if 96*len(r.chunks) > math.MaxUint32 {
-		panic(fmt.Errorf("Chunk length * 96 > %d", math.MaxUint32))
-	}
-	return 2 + uint32(r.baseFileInfo.Len()) + 8 + 4 + uint32(96*len(r.chunks))
+func (r regularFileInfo) Len() uint64 {
+	return 2 + r.baseFileInfo.Len() + 8 + extentsLen(r.extents) + 8 + uint64(chunkIdLength*len(r.chunks))
 }
 
-func (r regularFileInfo) Restore(readChunk readChunk) error {
-	file, err := os.OpenFile(r.name, os.O_RDWR, 0600)
+// Restore writes the file afresh, replacing whatever is at its path
+// rather than writing through a symlink or into another hard link left
+// there by an earlier run.  Holes are only recreated in a new file.
+func (r regularFileInfo) Restore(restorer *restorer) error {
+	err := removeExisting(r.name)
 	if err != nil {
-		switch {
-		case os.IsPermission(err):
-			err = os.Chmod(r.name, 0600)
-			if err != nil {
-				return err
-			}
-			file, err = os.Create(r.name)
-			if err != nil {
-				return err
-			}
-		case os.IsNotExist(err):
-			file, err = os.Create(r.name)
-			if err != nil {
-				return err
-			}
-		default:
-			return err
-		}
+		return restorer.report(r.name, err)
+	}
+	file, err := os.OpenFile(r.name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return restorer.report(r.name, err)
+	}
+	var out io.Writer = file
+	if r.extents != nil {
+		out = &extentWriter{file: file, extents: r.extents}
 	}
-	var j int
 	for i, chunkName := range r.chunks {
-		chunk, err := readChunk(chunkName)
+		chunk, err := restorer.readChunk(chunkName)
 		if err != nil {
 			file.Close()
 			return err
 		}
-		n, err := file.Write(chunk)
-		if n != len(chunk) {
-			return fmt.Errorf("Wrote %d of %d bytes of chunk %d of %s", n, len(chunk), i, r.name)
-		}
+		n, err := out.Write(chunk)
 		if err != nil {
 			file.Close()
 			return err
 		}
-		j += len(chunk)
+		if n != len(chunk) {
+			file.Close()
+			return fmt.Errorf("Wrote %d of %d bytes of chunk %d of %s", n, len(chunk), i, r.name)
+		}
 	}
+	err = file.Truncate(r.size)
 	file.Close()
-	err = r.baseFileInfo.Restore()
+	if err != nil {
+		return err
+	}
+	err = r.baseFileInfo.Restore(restorer)
 	if err != nil {
 		return err
 	}
@@ -318,19 +419,33 @@ type fifoInfo struct {
 	baseFileInfo
 }
 
-func (r fifoInfo) Record() (uint8, []byte) {
-	return 3, r.baseFileInfo.Record()
+func readFifo(reader io.Reader) (fileRecord, error) {
+	base, err := readBaseFileInfo(reader)
+	return fifoInfo{base}, err
+}
+
+func (r fifoInfo) Record() (uint8, []byte, error) {
+	data, err := r.baseFileInfo.Record()
+	return 4, data, err
 }
 
-func (r fifoInfo) Len() uint32 {
+func (r fifoInfo) Len() uint64 {
 	return 2 + r.baseFileInfo.Len()
 }
 
-func (r fifoInfo) Restore(readChunk) error {
-	return nil
+func (r fifoInfo) Restore(restorer *restorer) error {
+	err := removeExisting(r.name)
+	if err == nil {
+		err = mkfifo(r.name, r.mode)
+	}
+	if err != nil {
+		return restorer.report(r.name, err)
+	}
+	return r.baseFileInfo.Restore(restorer)
 }
 
-// FIXME: hard links aren't detected
+// A hardLinkInfo records a further link to a file already recorded in
+// the same run as LINKPATH
 type hardLinkInfo struct {
 	name     string
 	linkPath string
@@ -343,50 +458,63 @@ func readHardLink(reader io.Reader) (fileRecord, error) {
 	if err != nil {
 		return nil, err
 	}
-	pathBytes := make([]byte, pathLength)
-	n, err := reader.Read(pathBytes)
+	path, err := readLenString(reader, pathLength)
 	if err != nil {
 		return nil, err
 	}
-	if uint32(n) != pathLength {
-		return nil, fmt.Errorf("Error decoding backup set")
-	}
 	err = binary.Read(reader, binary.BigEndian, &targetPathLength)
 	if err != nil {
 		return nil, err
 	}
-	targetPathBytes := make([]byte, targetPathLength)
-	n, err = reader.Read(targetPathBytes)
+	targetPath, err := readLenString(reader, targetPathLength)
 	if err != nil {
 		return nil, err
 	}
-	if uint32(n) != targetPathLength {
-		return nil, fmt.Errorf("Error decoding backup set")
-	}
-	return hardLinkInfo{name: string(pathBytes), linkPath: string(targetPathBytes)}, nil
+	return hardLinkInfo{name: path, linkPath: targetPath}, nil
 }
 
-func (r hardLinkInfo) Record() (uint8, []byte) {
+func (r hardLinkInfo) Record() (uint8, []byte, error) {
 	writer := &bytes.Buffer{}
-	binary.Write(writer, binary.BigEndian, int32(len(r.name)))
-	writer.Write([]byte(r.name))
-	binary.Write(writer, binary.BigEndian, int32(len(r.linkPath)))
-	writer.Write([]byte(r.linkPath))
-	return 1, writer.Bytes()
+	err := writeLenString(writer, "name", r.name)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = writeLenString(writer, "link path", r.linkPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	return 1, writer.Bytes(), nil
 }
 
-func (r hardLinkInfo) Len() uint32 {
-	if len(r.name) > math.MaxUint32 {
-		panic(fmt.Errorf("Record name length > %d", math.MaxUint32))
-	}
-	if len(r.linkPath) > math.MaxUint32 {
-		panic(fmt.Errorf("Record link path > %d", math.MaxUint32))
+func (r hardLinkInfo) Len() uint64 {
+	return 2 + 4 + uint64(len(r.name)) + 4 + uint64(len(r.linkPath))
+}
+
+// Restore links the file to its first link, once that has been
+// restored
+func (r hardLinkInfo) Restore(restorer *restorer) error {
+	_, err := os.Lstat(r.linkPath)
+	if os.IsNotExist(err) {
+		restorer.pendingLinks = append(restorer.pendingLinks, r)
+		return nil
 	}
-	return 2 + 4 + uint32(len(r.name)) + 4 + uint32(len(r.linkPath))
+	return restorer.report(r.name, r.link())
 }
 
-func (r hardLinkInfo) Restore(readChunk) error {
-	return nil
+func (r hardLinkInfo) link() error {
+	target, err := os.Lstat(r.linkPath)
+	if err != nil {
+		return err
+	}
+	existing, err := os.Lstat(r.name)
+	if err == nil && os.SameFile(target, existing) {
+		return nil
+	}
+	err = removeExisting(r.name)
+	if err != nil {
+		return err
+	}
+	return os.Link(r.linkPath, r.name)
 }
 
 type symLinkInfo struct {
@@ -394,12 +522,18 @@ type symLinkInfo struct {
 	linkPath string
 }
 
-func (r symLinkInfo) Record() (uint8, []byte) {
+func (r symLinkInfo) Record() (uint8, []byte, error) {
 	writer := &bytes.Buffer{}
-	writer.Write(r.baseFileInfo.Record())
-	binary.Write(writer, binary.BigEndian, int32(len(r.linkPath)))
-	writer.Write([]byte(r.linkPath))
-	return 5, writer.Bytes()
+	base, err := r.baseFileInfo.Record()
+	if err != nil {
+		return 0, nil, err
+	}
+	writer.Write(base)
+	err = writeLenString(writer, "link path", r.linkPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	return 5, writer.Bytes(), nil
 }
 
 func readSymLink(reader io.Reader) (fileRecord, error) {
@@ -412,26 +546,31 @@ func readSymLink(reader io.Reader) (fileRecord, error) {
 	if err != nil {
 		return nil, err
 	}
-	targetPathBytes := make([]byte, targetPathLength)
-	n, err := reader.Read(targetPathBytes)
+	targetPath, err := readLenString(reader, targetPathLength)
 	if err != nil {
 		return nil, err
 	}
-	if uint32(n) != targetPathLength {
-		return nil, fmt.Errorf("Error decoding backup set")
-	}
-	return symLinkInfo{baseFileInfo: baseInfo, linkPath: string(targetPathBytes)}, nil
+	return symLinkInfo{baseFileInfo: baseInfo, linkPath: targetPath}, nil
 }
 
-func (r symLinkInfo) Len() uint32 {
-	if len(r.linkPath) > math.MaxUint32 {
-		panic(fmt.Errorf("Link path > %d", math.MaxUint32))
-	}
-	return 2 + r.baseFileInfo.Len() + 4 + uint32(len(r.linkPath))
+func (r symLinkInfo) Len() uint64 {
+	return 2 + r.baseFileInfo.Len() + 4 + uint64(len(r.linkPath))
 }
 
-func (r symLinkInfo) Restore(readChunk) error {
-	return nil
+// Restore creates the symlink and restores its owner, attributes and
+// times; a symlink's mode cannot be set
+func (r symLinkInfo) Restore(restorer *restorer) error {
+	err := removeExisting(r.name)
+	if err == nil {
+		err = os.Symlink(r.linkPath, r.name)
+	}
+	if err != nil {
+		return restorer.report(r.name, err)
+	}
+	errs := []error{restorer.restoreOwner(r.baseFileInfo)}
+	errs = append(errs, restoreXattrs(r.name, r.xattrs)...)
+	errs = append(errs, lchtimes(r.name, r.aTime, r.mTime))
+	return restorer.report(r.name, errs...)
 }
 
 type deviceInfo struct {
@@ -439,34 +578,79 @@ type deviceInfo struct {
 	rdev uint64
 }
 
-func (r deviceInfo) Record() []byte {
+func readDevice(reader io.Reader) (r deviceInfo, err error) {
+	r.baseFileInfo, err = readBaseFileInfo(reader)
+	if err != nil {
+		return r, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &r.rdev)
+	return r, err
+}
+
+func (r deviceInfo) Record() ([]byte, error) {
 	writer := &bytes.Buffer{}
+	base, err := r.baseFileInfo.Record()
+	if err != nil {
+		return nil, err
+	}
+	writer.Write(base)
 	binary.Write(writer, binary.BigEndian, r.rdev)
-	return writer.Bytes()
+	return writer.Bytes(), nil
 }
 
-func (r deviceInfo) Len() uint32 {
+func (r deviceInfo) Len() uint64 {
 	return 2 + r.baseFileInfo.Len() + 8
 }
 
-func (r deviceInfo) Restore(readChunk) error {
-	return nil
+// restore creates the device node, which only root may do
+func (r deviceInfo) restore(restorer *restorer, char bool) error {
+	if !restorer.root {
+		return restorer.report(r.name, fmt.Errorf("Only root can create devices"))
+	}
+	err := removeExisting(r.name)
+	if err == nil {
+		err = mknod(r.name, r.mode, char, r.rdev)
+	}
+	if err != nil {
+		return restorer.report(r.name, err)
+	}
+	return r.baseFileInfo.Restore(restorer)
 }
 
 type charDeviceInfo struct {
 	deviceInfo
 }
 
-func (r charDeviceInfo) Record() (uint8, []byte) {
-	return 2 + 6, r.deviceInfo.Record()
+func (r charDeviceInfo) Restore(restorer *restorer) error {
+	return r.restore(restorer, true)
+}
+
+func readCharDevice(reader io.Reader) (fileRecord, error) {
+	device, err := readDevice(reader)
+	return charDeviceInfo{device}, err
+}
+
+func (r charDeviceInfo) Record() (uint8, []byte, error) {
+	data, err := r.deviceInfo.Record()
+	return 6, data, err
 }
 
 type blockDeviceInfo struct {
 	deviceInfo
 }
 
-func (r blockDeviceInfo) Record() (uint8, []byte) {
-	return 7, r.deviceInfo.Record()
+func (r blockDeviceInfo) Restore(restorer *restorer) error {
+	return r.restore(restorer, false)
+}
+
+func readBlockDevice(reader io.Reader) (fileRecord, error) {
+	device, err := readDevice(reader)
+	return blockDeviceInfo{device}, err
+}
+
+func (r blockDeviceInfo) Record() (uint8, []byte, error) {
+	data, err := r.deviceInfo.Record()
+	return 7, data, err
 }
 
 type directoryInfo struct {
@@ -479,20 +663,31 @@ func readDirectory(reader io.Reader) (fileRecord, error) {
 	return directoryInfo{base}, err
 }
 
-func (r directoryInfo) Record() (uint8, []byte) {
-	return 2, r.baseFileInfo.Record()
+func (r directoryInfo) Record() (uint8, []byte, error) {
+	data, err := r.baseFileInfo.Record()
+	return 2, data, err
 }
 
-func (r directoryInfo) Len() uint32 {
+func (r directoryInfo) Len() uint64 {
 	return 2 + r.baseFileInfo.Len()
 }
 
-func (r directoryInfo) Restore(readChunk) (err error) {
+// Restore creates the directory, or reuses one already at its path; a
+// symlink or other file there is replaced, so that the directory's
+// attributes are never set through it.
+func (r directoryInfo) Restore(restorer *restorer) (err error) {
+	info, err := os.Lstat(r.name)
+	if err == nil && !info.IsDir() {
+		err = removeExisting(r.name)
+		if err != nil {
+			return restorer.report(r.name, err)
+		}
+	}
 	err = os.Mkdir(r.name, r.mode)
 	if err != nil && !os.IsExist(err) {
 		return err
 	}
-	err = r.baseFileInfo.Restore()
+	err = r.baseFileInfo.Restore(restorer)
 	if err != nil {
 		return err
 	}
@@ -503,7 +698,7 @@ type endRecord struct {
 	hash []byte
 }
 
-func (r endRecord) Restore(readChunk) error {
+func (r endRecord) Restore(*restorer) error {
 	return nil
 }
 
@@ -516,19 +711,22 @@ func readEndRecord(reader io.Reader) (fileRecord, error) {
 	return endRecord{hash}, nil
 }
 
-func (r endRecord) Record() (uint8, []byte) {
-	return 8, r.hash
+func (r endRecord) Record() (uint8, []byte, error) {
+	return 8, r.hash, nil
 }
 
-func (r endRecord) Len() uint32 {
+func (r endRecord) Len() uint64 {
 	return 2 + 48
 }
 
 func (b *BackupSet) fileRecordFromFileInfo(path string, info os.FileInfo) (record fileRecord, err error) {
-	stat, statOk := info.Sys().(syscall.Stat_t)
+	stat, statOk := info.Sys().(*syscall.Stat_t)
+	// directories always have several links, but cannot be hard
+	// linked
+	linked := statOk && stat.Nlink > 1 && !info.IsDir()
 	var inode devInode
-	if statOk {
-		inode := devInode{stat.Dev, stat.Ino}
+	if linked {
+		inode = devInode{uint64(stat.Dev), uint64(stat.Ino)}
 		if targetPath, ok := b.hardLinks[inode]; ok {
 			return &hardLinkInfo{path, targetPath}, nil
 		}
@@ -538,32 +736,39 @@ func (b *BackupSet) fileRecordFromFileInfo(path string, info os.FileInfo) (recor
 	case mode&os.ModeDir != 0:
 		record = b.newDirectoryInfo(path, info)
 	case mode&os.ModeSymlink != 0:
-		path, err := os.Readlink(path)
+		target, err := os.Readlink(path)
 		if err != nil {
-			return nil, err
+			return nil, &FileError{path, err}
 		}
-		record = &symLinkInfo{b.newBaseFileInfo(path, info), path}
+		record = &symLinkInfo{b.newBaseFileInfo(path, info), target}
 	case mode&os.ModeDevice != 0:
 		if statOk {
 			if mode&os.ModeCharDevice != 0 {
-				record = &charDeviceInfo{deviceInfo{b.newBaseFileInfo(path, info), stat.Rdev}}
+				record = &charDeviceInfo{deviceInfo{b.newBaseFileInfo(path, info), uint64(stat.Rdev)}}
 			} else {
-				record = &blockDeviceInfo{deviceInfo{b.newBaseFileInfo(path, info), stat.Rdev}}
+				record = &blockDeviceInfo{deviceInfo{b.newBaseFileInfo(path, info), uint64(stat.Rdev)}}
 			}
 		} else {
-			return nil, fmt.Errorf("Cannot handle device file " + path)
+			return nil, &FileError{path, fmt.Errorf("Cannot handle device file")}
 		}
 	case mode&os.ModeNamedPipe != 0:
 		record = &fifoInfo{b.newBaseFileInfo(path, info)}
 	case mode&os.ModeSocket != 0:
-		return nil, fmt.Errorf("Cannot handle sockets")
+		return nil, &FileError{path, fmt.Errorf("Cannot handle sockets")}
 	default:
 		record, err = b.newRegularFileInfo(path, info)
 		if err != nil {
 			return nil, err
 		}
 	}
-	if statOk {
+	xattrs, err := b.readXattrs(path)
+	if err != nil {
+		return nil, &FileError{path, err}
+	}
+	if len(xattrs) > 0 {
+		record.(xattrSetter).setExtendedAttributes(xattrs)
+	}
+	if linked {
 		b.hardLinks[inode] = path
 	}
 	return record, nil
@@ -575,23 +780,34 @@ func (b *BackupSet) newDirectoryInfo(path string, info os.FileInfo) *directoryIn
 
 func (b *BackupSet) newRegularFileInfo(path string, info os.FileInfo) (fileInfo *regularFileInfo, err error) {
 	baseFileInfo := b.newBaseFileInfo(path, info)
-	fileInfo = &regularFileInfo{baseFileInfo, info.Size(), make([]string, 0)}
+	fileInfo = &regularFileInfo{baseFileInfo: baseFileInfo, size: info.Size(), chunks: make([]string, 0)}
 	if info.Size() > 0 {
 		storageHash := hmac.New(sha512.New384, b.secrets.chunkStorage)
+		// errors reading the file are the file's; errors writing
+		// its chunks are the backup's
 		file, err := os.Open(path)
 		if err != nil {
-			return nil, err
+			return nil, &FileError{path, err}
+		}
+		defer file.Close()
+		fileInfo.extents, err = sparseExtents(file, info)
+		if err != nil {
+			return nil, &FileError{path, err}
 		}
 		chunk := make([]byte, 256*1024)
-		plaintext := io.TeeReader(file, storageHash)
+		// only a sparse file's data is chunked, without its holes
+		plaintext := io.TeeReader(dataReader(file, info.Size(), fileInfo.extents), storageHash)
 		var readErr error
 		for {
 			storageHash.Reset()
 			var n int
-			n, readErr = plaintext.Read(chunk)
+			n, readErr = io.ReadFull(plaintext, chunk)
+			if readErr == io.ErrUnexpectedEOF {
+				readErr = io.EOF
+			}
 			if n == 0 {
 				if readErr != nil && readErr != io.EOF {
-					return nil, err
+					return nil, &FileError{path, readErr}
 				}
 				break
 			}
@@ -602,37 +818,27 @@ func (b *BackupSet) newRegularFileInfo(path string, info os.FileInfo) (fileInfo
 			if b.seenChunks[string(storageLoc)] {
 				continue
 			}
-			chunkPath := filepath.Join(b.tempDir, hexStorageLoc)
-			chunkFile, err := os.Create(chunkPath)
-			if err != nil {
-				return nil, err
-			}
-			defer chunkFile.Close()
-			encryptor, err := newEncWriter(chunkFile, b.secrets)
+			err = b.ensureTempDir()
 			if err != nil {
 				return nil, err
 			}
-			compressor := lzw.NewWriter(encryptor, lzw.LSB, 8)
-			_, err = compressor.Write(chunk[:n])
-			if err != nil {
-				return nil, err
-			}
-			err = compressor.Close()
+			chunkPath := filepath.Join(b.tempDir, hexStorageLoc)
+			chunkFile, err := os.Create(chunkPath)
 			if err != nil {
 				return nil, err
 			}
-			err = encryptor.Close()
+			err = writeChunk(chunkFile, b.secrets, chunk[:n], b.compression, b.padding)
+			chunkFile.Close()
 			if err != nil {
 				return nil, err
 			}
 			b.seenChunks[string(storageLoc)] = true
 			if readErr != nil {
-				fmt.Fprintln(os.Stderr, readErr)
 				break
 			}
 		}
 		if readErr != io.EOF {
-			return nil, err
+			return nil, &FileError{path, readErr}
 		}
 	}
 	//fmt.Println(">", info.Size(), fileInfo.chunks)
@@ -643,24 +849,30 @@ func (b *BackupSet) newBaseFileInfo(path string, info os.FileInfo) baseFileInfo
 	stat := info.Sys()
 	switch stat := stat.(type) {
 	case *syscall.Stat_t:
-		user, err := user.LookupId(fmt.Sprintf("%d", stat.Uid))
+		owner, err := user.LookupId(fmt.Sprintf("%d", stat.Uid))
 		var userName string
 		if err != nil {
 			userName = ""
 		} else {
-			userName = user.Username
+			userName = owner.Username
+		}
+		var groupName string
+		group, err := user.LookupGroupId(fmt.Sprintf("%d", stat.Gid))
+		if err == nil {
+			groupName = group.Name
 		}
 		aTime := time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
 		cTime := time.Unix(stat.Ctim.Sec, stat.Ctim.Nsec)
 		mTime := time.Unix(stat.Mtim.Sec, stat.Mtim.Nsec)
 		return baseFileInfo{name: path,
-			mode:     info.Mode(), //os.FileMode(stat.Mode),
-			uid:      stat.Uid,
-			gid:      stat.Gid,
-			userName: userName,
-			aTime:    aTime,
-			cTime:    cTime,
-			mTime:    mTime}
+			mode:      info.Mode(), //os.FileMode(stat.Mode),
+			uid:       stat.Uid,
+			gid:       stat.Gid,
+			userName:  userName,
+			groupName: groupName,
+			aTime:     aTime,
+			cTime:     cTime,
+			mTime:     mTime}
 	default:
 		return baseFileInfo{name: path,
 			mode: info.Mode()}
@@ -675,9 +887,10 @@ func tagToId(secrets *Secrets, tag string) string {
 }
 
 // EnsureBackupSet will return the backup set tagged TAG, creating it
-// if necessary
+// if necessary.  Its existing runs are not loaded, unless it predates
+// indices.
 func EnsureBackupSet(backend Backend, secrets *Secrets, tag string) (b *BackupSet, err error) {
-	b, err = ReadBackupSet(backend, secrets, tag)
+	b, err = readBackupSet(backend, secrets, tagToId(secrets, tag))
 	if err == NoSuchBackupSet {
 		set, err := newBackupSet(tag, secrets)
 		if err != nil {
@@ -689,31 +902,119 @@ func EnsureBackupSet(backend Backend, secrets *Secrets, tag string) (b *BackupSe
 }
 
 var (
-	NoSuchBackupSet = fmt.Errorf("Backup set does not exist")
+	NoSuchBackupSet    = fmt.Errorf("Backup set does not exist")
+	AppendNotSupported = fmt.Errorf("Backend cannot append to backup sets")
 )
 
-// ReadBackupSet will read a backup set from disk
+// ReadBackupSet will read a backup set, and all its runs, from disk
 func ReadBackupSet(backend Backend, secrets *Secrets, tag string) (b *BackupSet, err error) {
-	id := tagToId(secrets, tag)
-	existingData, err := backend.ReadBackupSet(secrets.HexId(), id)
+	return ReadBackupSetRuns(backend, secrets, tag, 0)
+}
+
+// Backup sets have more format versions than chunks: version 3 sets
+// are sealed a segment at a time, so that they can be appended to in
+// place, version 4 sets hold an index of separately stored runs and
+// version 5 sets also hold a generation
+const (
+	segmentedVersion  = 3
+	currentSetVersion = generationVersion // see generations.go
+)
+
+// validSetVersion reports whether VERSION is a known backup set format
+// version
+func validSetVersion(version uint8) bool {
+	return version <= generationVersion
+}
+
+func (b *BackupSet) encode() ([]byte, error) {
+	return b.encodeVersion(currentSetVersion)
+}
+
+// Record versions.  Bit 0 marks a record followed by extended
+// attributes (see xattr.go).  Versions 0 and 1 wrote FIFOs as regular
+// files and device nodes without their file headers, so device
+// records of those versions are refused.  Versions 2 and 3 wrote run
+// lengths and chunk counts in 32 bits and chunk IDs in hex; from
+// version 4 they are 64 bits wide and IDs are binary.
+const (
+	xattrRecordFlag      = 1
+	deviceRecordVersion  = 2
+	wideRecordVersion    = 4
+	currentRecordVersion = wideRecordVersion
+	maxRecordVersion     = currentRecordVersion | xattrRecordFlag
+)
+
+// writeRecords writes RECORDS, each preceded by its version and type,
+// to WRITER
+func writeRecords(writer io.Writer, records []fileRecord) error {
+	for _, record := range records {
+		version, recordType, data, err := encodeRecord(record)
+		if err != nil {
+			return err
+		}
+		binary.Write(writer, binary.BigEndian, version)
+		binary.Write(writer, binary.BigEndian, recordType)
+		n, err := writer.Write(data)
+		if err != nil {
+			return err
+		}
+		if n != len(data) {
+			return fmt.Errorf("Error encoding backup set")
+		}
+	}
+	return nil
+}
+
+// segmentNonce returns the GCM nonce of segment NUMBER: the first 96
+// bits of IV, with NUMBER XORed into the last 32 of them
+func segmentNonce(iv []byte, number uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, iv)
+	binary.BigEndian.PutUint32(nonce[8:], binary.BigEndian.Uint32(nonce[8:])^number)
+	return nonce
+}
+
+// segmentData returns the additional data authenticated with segment
+// NUMBER of a set whose version and nonce are HEADER
+func segmentData(header []byte, number uint32) []byte {
+	data := make([]byte, len(header)+4)
+	copy(data, header)
+	binary.BigEndian.PutUint32(data[len(header):], number)
+	return data
+}
+
+// sealSegment pads PLAINTEXT according to PAD and seals it as segment
+// NUMBER of the set whose version and nonce are HEADER, returning it
+// preceded by its length
+func sealSegment(aead cipher.AEAD, iv, header []byte, number uint32, plaintext []byte, pad padding) ([]byte, error) {
+	padded, err := padPlaintext(plaintext, pad)
 	if err != nil {
-		return nil, NoSuchBackupSet
+		return nil, err
 	}
-	return decodeBackupSet(secrets, existingData)
+	segment := make([]byte, 4, 4+len(padded)+aead.Overhead())
+	segment = aead.Seal(segment, segmentNonce(iv, number), padded, segmentData(header, number))
+	binary.BigEndian.PutUint32(segment, uint32(len(segment)-4))
+	return segment, nil
 }
 
-func (b *BackupSet) encode() ([]byte, error) {
+// encodeVersion encrypts and authenticates the backup set in format
+// VERSION
+func (b *BackupSet) encodeVersion(version uint8) ([]byte, error) {
+	if !validSetVersion(version) {
+		return nil, fmt.Errorf("Unsupported backup set version %d", version)
+	}
 	digester := hmac.New(sha512.New384, b.secrets.metadataAuthentication)
 	buffer := &bytes.Buffer{}
-	writer := io.MultiWriter(digester, buffer)
-	n, err := writer.Write([]byte{0}) // version
+	output := io.MultiWriter(digester, buffer)
+	writer := output
+	n, err := writer.Write([]byte{version})
 	if err != nil {
 		return nil, err
 	}
 	if n != 1 {
 		return nil, fmt.Errorf("Error encoding backup set")
 	}
-	nonce, err := genKey(48)
+	nonce, err := genNonce(48)
 	if err != nil {
 		return nil, err
 	}
@@ -725,6 +1026,7 @@ func (b *BackupSet) encode() ([]byte, error) {
 		return nil, fmt.Errorf("Error encoding backup set")
 	}
 	keyMat := nistConcatKDF(b.secrets.metadataMaster, []byte("metadata encryption"), nonce, 48)
+	defer keyMat.wipe()
 	key := keyMat[0:32]
 	iv := keyMat[32:48]
 	aesCypher, err := aes.NewCipher(key)
@@ -732,7 +1034,7 @@ func (b *BackupSet) encode() ([]byte, error) {
 		return nil, err
 	}
 	exitEarlyDigester := hmac.New(sha512.New384, b.secrets.metadataAuthentication)
-	exitEarlyDigester.Write([]byte{0}) // version
+	exitEarlyDigester.Write([]byte{version})
 	exitEarlyDigester.Write(nonce)
 	exitEarlyDigester.Write(key)
 	exitEarlyDigester.Write(iv)
@@ -741,8 +1043,18 @@ func (b *BackupSet) encode() ([]byte, error) {
 		return nil, err
 	}
 	exitEarlyDigester.Write([]byte(b.tag))
-	cypher := cipher.NewCTR(aesCypher, iv)
-	writer = cipher.StreamWriter{S: cypher, W: writer}
+	if version >= generationVersion {
+		binary.Write(exitEarlyDigester, binary.BigEndian, b.generation)
+	}
+	// CTR encrypts the set as it is written; GCM needs all of it at
+	// once, so it is gathered first
+	plaintext := &bytes.Buffer{}
+	if version == ctrVersion {
+		cypher := cipher.NewCTR(aesCypher, iv)
+		writer = cipher.StreamWriter{S: cypher, W: writer}
+	} else {
+		writer = plaintext
+	}
 	//writer = io.MultiWriter(digester, stream)
 	err = binary.Write(writer, binary.BigEndian, uint32(len(b.tag)))
 	if err != nil {
@@ -755,168 +1067,91 @@ func (b *BackupSet) encode() ([]byte, error) {
 	if n != len([]byte(b.tag)) {
 		return nil, fmt.Errorf("Error encoding backup set")
 	}
-	exitEarlySum := exitEarlyDigester.Sum(nil)
-	n, err = writer.Write(exitEarlySum)
-	if err != nil {
-		return nil, err
-	}
-	if n != len(exitEarlySum) {
-		return nil, fmt.Errorf("Error encoding backup set")
-	}
-	for _, record := range b.records {
-		recordType, data := record.Record()
-		binary.Write(writer, binary.BigEndian, uint8(0)) // version
-		binary.Write(writer, binary.BigEndian, recordType)
-		n, err = writer.Write(data)
+	if version >= generationVersion {
+		err = binary.Write(writer, binary.BigEndian, b.generation)
 		if err != nil {
 			return nil, err
 		}
-		if n != len(data) {
-			return nil, fmt.Errorf("Error encoding backup set")
-		}
 	}
-	n, err = buffer.Write(digester.Sum(nil))
+	exitEarlySum := exitEarlyDigester.Sum(nil)
+	n, err = writer.Write(exitEarlySum)
 	if err != nil {
 		return nil, err
 	}
-	if n != 48 {
+	if n != len(exitEarlySum) {
 		return nil, fmt.Errorf("Error encoding backup set")
 	}
-	return buffer.Bytes(), nil
-}
-
-func decodeBackupSet(secrets *Secrets, data []byte) (*BackupSet, error) {
-	b, err := newBackupSet("", secrets)
-	if err != nil {
-		return nil, err
+	if version >= indexedVersion {
+		err = writeRunIndex(writer, b.runs)
+	} else {
+		err = writeRecords(writer, b.records)
 	}
-	digester := hmac.New(sha512.New384, secrets.metadataAuthentication)
-	buffer := bytes.NewReader(data)
-	reader := io.TeeReader(buffer, digester)
-	version := make([]byte, 1)
-	n, err := reader.Read(version)
 	if err != nil {
 		return nil, err
 	}
-	if n != 1 {
-		return nil, fmt.Errorf("Error reading backup set version")
-	}
-	if version[0] != 0 {
-		return nil, fmt.Errorf("Unsupported file version %d", version[0])
-	}
-	nonce := make([]byte, 48)
-	n, err = reader.Read(nonce)
-	if err != nil {
-		return nil, err
-	}
-	if n != 48 {
-		return nil, fmt.Errorf("Error reading backup set nonce")
-	}
-	keyMat := nistConcatKDF(secrets.metadataMaster, []byte("metadata encryption"), nonce, 48)
-	key := keyMat[0:32]
-	iv := keyMat[32:48]
-	aesCypher, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-	exitEarlyDigester := hmac.New(sha512.New384, secrets.metadataAuthentication)
-	exitEarlyDigester.Write([]byte{0}) // version
-	exitEarlyDigester.Write(nonce)
-	exitEarlyDigester.Write(key)
-	exitEarlyDigester.Write(iv)
-	cypher := cipher.NewCTR(aesCypher, iv)
-	reader = cipher.StreamReader{S: cypher, R: reader}
-	//reader = io.TeeReader(stream, digester)
-	var tagLen uint32
-	err = binary.Read(reader, binary.BigEndian, &tagLen)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Write(exitEarlyDigester, binary.BigEndian, tagLen)
-	if err != nil {
-		return nil, err
-	}
-	tagBytes := make([]byte, tagLen)
-	n, err = reader.Read(tagBytes)
-	if err != nil {
-		return nil, err
-	}
-	if n != int(tagLen) {
-		return nil, fmt.Errorf("Error decoding backup set")
-	}
-	exitEarlyDigester.Write(tagBytes)
-	b.tag = string(tagBytes)
-	exitEarlySum := make([]byte, 48)
-	n, err = reader.Read(exitEarlySum)
-	if err != nil {
-		return nil, err
-	}
-	if n != len(exitEarlySum) {
-		return nil, fmt.Errorf("Error decoding backup set")
-	}
-	if !bytes.Equal(exitEarlySum, exitEarlyDigester.Sum(nil)) {
-		return nil, fmt.Errorf("Error decoding backup set")
-	}
-	var bytesToRead uint32
-	bytesToRead = uint32(len(data)) - (1 + 48 + 4 + tagLen + 48 + 48)
-	lastWasEnd := true
-	for {
-		var record fileRecord
-		var version uint8
-		var recordType uint8
-		err = binary.Read(reader, binary.BigEndian, &version)
+	if version >= segmentedVersion {
+		aead, err := cipher.NewGCM(aesCypher)
 		if err != nil {
 			return nil, err
 		}
-		if version != 0 {
-			return nil, fmt.Errorf("Error decoding backup set: unknown version %d", version)
+		segment, err := sealSegment(aead, iv, buffer.Bytes(), 0, plaintext.Bytes(), b.padding)
+		if err != nil {
+			return nil, err
 		}
-		err = binary.Read(reader, binary.BigEndian, &recordType)
+		n, err = output.Write(segment)
 		if err != nil {
 			return nil, err
 		}
-		switch recordType {
-		case 0:
-			if !lastWasEnd {
-				return nil, fmt.Errorf("Error decoding backup set: unexpected start record")
+		if n != len(segment) {
+			return nil, fmt.Errorf("Error encoding backup set")
+		}
+	} else if version >= gcmVersion {
+		aead, err := cipher.NewGCM(aesCypher)
+		if err != nil {
+			return nil, err
+		}
+		setPlaintext := plaintext.Bytes()
+		if version >= paddedVersion {
+			setPlaintext, err = padPlaintext(setPlaintext, b.padding)
+			if err != nil {
+				return nil, err
 			}
-			record, err = readStartRecord(reader)
-			lastWasEnd = false
-			//bytesToRead = record.(startRecord).length
-		case 1:
-			record, err = readHardLink(reader)
-		case 2:
-			record, err = readDirectory(reader)
-		case 3:
-			record, err = readRegularFile(reader)
-		case 5:
-			record, err = readSymLink(reader)
-		case 8:
-			record, err = readEndRecord(reader)
-			lastWasEnd = true
-		default:
-			return nil, fmt.Errorf("Error decoding backup set: unsupported type %d", recordType)
 		}
-		if err != nil && err != io.EOF {
+		// the version and nonce are authenticated too
+		sealed := aead.Seal(nil, iv[:aead.NonceSize()], setPlaintext, buffer.Bytes())
+		n, err = output.Write(sealed)
+		if err != nil {
 			return nil, err
 		}
-		b.records = append(b.records, record)
-		bytesToRead -= record.Len()
-		if bytesToRead == 0 {
-			break
+		if n != len(sealed) {
+			return nil, fmt.Errorf("Error encoding backup set")
 		}
 	}
-	digest, err := ioutil.ReadAll(buffer)
-	/*digest := make([]byte, 48)
-	n, err = buffer.Read(digest)*/
-	if err != nil && err != io.EOF {
+	n, err = buffer.Write(digester.Sum(nil))
+	if err != nil {
 		return nil, err
 	}
-	if len(digest) != 48 {
-		return nil, fmt.Errorf("Error decoding backup set: could not read authentication tag %d", len(digest))
+	if n != 48 {
+		return nil, fmt.Errorf("Error encoding backup set")
+	}
+	return buffer.Bytes(), nil
+}
+
+func decodeBackupSet(secrets *Secrets, data []byte) (*BackupSet, error) {
+	var records []fileRecord
+	b, err := streamBackupSet(secrets, bytes.NewReader(data), func(record fileRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if !bytes.Equal(digest, digester.Sum(nil)) {
-		return nil, fmt.Errorf("Error decoding backup set: invalid authentication tag %s/%s", hex.EncodeToString(digest), hex.EncodeToString(digester.Sum(nil)))
+	b.records = records
+	// older indices are rewritten in the current version rather than
+	// appended to
+	if data[0] == currentSetVersion {
+		b.encoded = data
+		b.encodedRuns = len(b.runs)
 	}
 	return b, nil
 }
@@ -928,6 +1163,9 @@ func (b *BackupSet) StartBackup() error {
 			return fmt.Errorf("Final existing record in backup set is not an end record")
 		}
 	}
+	// links are only recorded to files earlier in the same run
+	b.hardLinks = make(map[devInode]string)
+	b.fileErrors = nil
 	// will update the start record when ending backup
 	start := startRecord{date: time.Now()}
 	b.records = append(b.records, start)
@@ -943,34 +1181,55 @@ func (b *BackupSet) EndBackup() error {
 	if !ok {
 		return fmt.Errorf("Corrupted backup set: purported last start record is not a start record")
 	}
-	start.length = 0
+	start.length = runLength(b.records[b.lastStartIndex:])
+	b.records[b.lastStartIndex] = start
+	end, err := runDigest(b.records[b.lastStartIndex:])
+	if err != nil {
+		return err
+	}
+	b.records = append(b.records, endRecord{end})
+	return nil
+}
+
+// runLength returns the length of the run of which RECORDS are all
+// but the end record.  The end record is of fixed length, so the start
+// record can be completed before the run is digested.
+func runLength(records []fileRecord) uint64 {
+	length := endRecord{}.Len()
+	for _, record := range records {
+		length += record.Len()
+	}
+	return length
+}
+
+// runDigest returns the SHA-384 of RECORDS, which form a run from its
+// start record up to but excluding its end record
+func runDigest(records []fileRecord) ([]byte, error) {
 	digester := sha512.New384()
-	for i := b.lastStartIndex; i < len(b.records); i++ {
-		start.length += b.records[i].Len()
-		recordType, data := b.records[i].Record()
-		err := binary.Write(digester, binary.BigEndian, uint8(0))
+	for _, record := range records {
+		version, recordType, data, err := encodeRecord(record)
 		if err != nil {
-			return err
-		}
-		err = binary.Write(digester, binary.BigEndian, recordType)
-		if err != nil {
-			return err
+			return nil, err
 		}
+		// no errors are possible from hash.Write, per the docs
+		binary.Write(digester, binary.BigEndian, version)
+		binary.Write(digester, binary.BigEndian, recordType)
 		digester.Write(data)
 	}
-	end := endRecord{digester.Sum(nil)}
-	start.length += end.Len()
-	b.records[b.lastStartIndex] = start
-	b.records = append(b.records, end)
-	return nil
+	return digester.Sum(nil), nil
 }
 
+// Write stores the chunks of the set's new files, then each new run
+// and finally the set's index.  If BACKEND can append to a backup set
+// and the index was read from or written to it in the current format,
+// only the new runs' entries are written; otherwise the whole index
+// is rewritten under a new nonce.
 func (b *BackupSet) Write(backend Backend) error {
-	encSet, err := b.encode()
+	secretsId := b.secrets.HexId()
+	err := b.ensureTempDir()
 	if err != nil {
 		return err
 	}
-	secretsId := b.secrets.HexId()
 	chunkInfo, err := ioutil.ReadDir(b.tempDir)
 	if err != nil {
 		return err
@@ -990,7 +1249,105 @@ func (b *BackupSet) Write(backend Backend) error {
 			return err
 		}
 	}
-	return backend.WriteBackupSet(secretsId, tagToId(b.secrets, b.tag), encSet)
+	return b.writeMetadata(backend)
+}
+
+// writeMetadata stores each complete run added since the set was read
+// or written as a run object, then the set's index and finally the
+// catalog
+func (b *BackupSet) writeMetadata(backend Backend) error {
+	id := tagToId(b.secrets, b.tag)
+	start := b.encodedRecords
+	newRuns := false
+	for i := b.encodedRecords; i < len(b.records); i++ {
+		if _, ok := b.records[i].(endRecord); !ok {
+			continue
+		}
+		run, err := b.writeRun(backend, id, b.records[start:i+1])
+		if err != nil {
+			return err
+		}
+		b.runs = append(b.runs, run)
+		start = i + 1
+		newRuns = true
+	}
+	size := lastRunSize(b.records[:start])
+	b.encodedRecords = start
+	err := b.writeIndex(backend)
+	if err != nil {
+		return err
+	}
+	return b.updateCatalog(backend, size, newRuns)
+}
+
+// writeIndex writes the set's index, appending to it if possible
+func (b *BackupSet) writeIndex(backend Backend) error {
+	secretsId := b.secrets.HexId()
+	id := tagToId(b.secrets, b.tag)
+	if appender, ok := backend.(BackupSetAppender); ok && b.encoded != nil {
+		if b.encodedRuns == len(b.runs) {
+			return nil
+		}
+		offset, tail, err := b.encodeAppend()
+		if err != nil {
+			return err
+		}
+		err = appender.AppendBackupSet(secretsId, id, int64(offset), tail)
+		if err == nil {
+			b.encoded = append(b.encoded[:offset:offset], tail...)
+			b.encodedRuns = len(b.runs)
+			b.segments++
+			b.generation++
+			return generationCache.check(secretsId, id, b.generation)
+		}
+		// fall back to rewriting the whole index, which also
+		// repairs a partial append
+	}
+	b.generation = generationCache.next(secretsId, id, b.generation)
+	encSet, err := b.encode()
+	if err != nil {
+		return err
+	}
+	err = backend.WriteBackupSet(secretsId, id, encSet)
+	if err != nil {
+		return err
+	}
+	b.encoded = encSet
+	b.encodedRuns = len(b.runs)
+	b.segments = 1
+	return generationCache.check(secretsId, id, b.generation)
+}
+
+// encodeAppend seals the index entries of the runs added since the
+// index was last read or written as a new segment, returning the
+// offset of the set's HMAC and the segment and new HMAC with which to
+// overwrite it
+func (b *BackupSet) encodeAppend() (offset int, tail []byte, err error) {
+	authLength := len(b.encoded) - sha512.Size384
+	header := b.encoded[:1+48]
+	keyMat := nistConcatKDF(b.secrets.metadataMaster, []byte("metadata encryption"), header[1:], 48)
+	defer keyMat.wipe()
+	aesCypher, err := aes.NewCipher(keyMat[0:32])
+	if err != nil {
+		return 0, nil, err
+	}
+	aead, err := cipher.NewGCM(aesCypher)
+	if err != nil {
+		return 0, nil, err
+	}
+	plaintext := &bytes.Buffer{}
+	err = writeRunIndex(plaintext, b.runs[b.encodedRuns:])
+	if err != nil {
+		return 0, nil, err
+	}
+	segment, err := sealSegment(aead, keyMat[32:48], header, b.segments, plaintext.Bytes(), b.padding)
+	if err != nil {
+		return 0, nil, err
+	}
+	digester := hmac.New(sha512.New384, b.secrets.metadataAuthentication)
+	digester.Write(b.encoded[:authLength])
+	digester.Write(segment)
+	return authLength, digester.Sum(segment), nil
 }
 
 func readLenString(reader io.Reader, length uint32) (string, error) {
@@ -999,57 +1356,64 @@ func readLenString(reader io.Reader, length uint32) (string, error) {
 	return string(stringBytes), err
 }
 
+// writeLenString writes S, the record's WHAT, to WRITER preceded by
+// its 4-byte length
+func writeLenString(writer io.Writer, what, s string) error {
+	if uint64(len(s)) > math.MaxUint32 {
+		return fmt.Errorf("Record %s length > %d", what, uint64(math.MaxUint32))
+	}
+	binary.Write(writer, binary.BigEndian, uint32(len(s)))
+	_, err := io.WriteString(writer, s)
+	return err
+}
+
 // FIXME: this is a horrible method and should instead be WalkRecords, with exported record types, or something
 func (b *BackupSet) ListRecords() {
 	for i := range b.records {
-		switch record := b.records[i].(type) {
-		case startRecord:
-			fmt.Printf("@%s\n", record.date.Format(time.RFC3339))
-		case endRecord:
-			fmt.Println()
-		case directoryInfo:
-			fmt.Printf("%s/\n", record.name)
-		case regularFileInfo:
-			fmt.Println(record.name)
-		case symLinkInfo:
-			fmt.Printf("%s -> %s", record.name, record.linkPath)
-		default:
-			fmt.Printf("%T: %v\n", record, record)
+		listRecord(os.Stdout, b.records[i])
+	}
+}
+
+// listRecord writes a line describing RECORD to W
+func listRecord(w io.Writer, record fileRecord) {
+	switch record := record.(type) {
+	case startRecord:
+		fmt.Fprintf(w, "@%s\n", record.date.Format(time.RFC3339))
+	case endRecord:
+		fmt.Fprintln(w)
+	case directoryInfo:
+		fmt.Fprintf(w, "%s/\n", record.name)
+	case regularFileInfo:
+		fmt.Fprintln(w, record.name)
+	case symLinkInfo:
+		fmt.Fprintf(w, "%s -> %s", record.name, record.linkPath)
+	case errorRecord:
+		fmt.Fprintf(w, "%s: not backed up: %s\n", record.name, record.message)
+	default:
+		fmt.Fprintf(w, "%T: %v\n", record, record)
+	}
+}
+
+// chunkReader returns a function which reads and decrypts chunks of
+// SECRETS from BACKEND
+func chunkReader(backend Backend, secrets *Secrets) readChunk {
+	secretsId := secrets.HexId()
+	return func(id string) (data []byte, err error) {
+		chunk, err := backend.ReadChunk(secretsId, id)
+		if err != nil {
+			return nil, err
 		}
+		return decryptChunk(secrets, chunk)
 	}
 }
 
 func (b *BackupSet) Restore(backend Backend) error {
+	restorer := newRestorer(backend, b.secrets, nil)
 	for _, record := range b.records {
-		secretsId := hex.EncodeToString(b.secrets.Id())
-		err := record.Restore(func(id string) (data []byte, err error) {
-			chunk, err := backend.ReadChunk(secretsId, id)
-			if err != nil {
-				return nil, err
-			}
-			encReader, err := newEncReader(bytes.NewReader(chunk), b.secrets, len(chunk))
-			if err != nil {
-				return nil, err
-			}
-			compressor := lzw.NewReader(encReader, lzw.LSB, 8)
-			data, err = ioutil.ReadAll(compressor)
-			if err != nil {
-				return nil, err
-			}
-			//fmt.Printf("retrieved %d bytes", len(data))
-			err = compressor.Close()
-			if err != nil {
-				return nil, err
-			}
-			err = encReader.Close()
-			if err != nil {
-				return nil, err
-			}
-			return data, nil
-		})
+		err := record.Restore(restorer)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return restorer.finish()
 }
@@ -20,7 +20,12 @@ package cypherback
 import (
 	"bytes"
 	memoryBackend "cypherback/backends/memory"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestWriteReadBackupSet(t *testing.T) {
@@ -37,7 +42,7 @@ func TestWriteReadBackupSet(t *testing.T) {
 
 func TestBackupSet(t *testing.T) {
 	backend := memoryBackend.New()
-	secrets, err := GenerateSecrets(backend)
+	secrets, err := GenerateSecrets(backend, DefaultKDF(), "")
 	defer ZeroSecrets(secrets)
 	if err != nil {
 		t.Fatal(err)
@@ -50,3 +55,248 @@ func TestBackupSet(t *testing.T) {
 		t.Fatal("nil")
 	}
 }
+
+func TestBackupSetVersions(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := newBackupSet("foo", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.StartBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.records = append(set.records, symLinkInfo{baseFileInfo{name: "/tmp/link", mode: os.ModeSymlink | 0777}, "target"})
+	err = set.EndBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []uint8{ctrVersion, gcmVersion, paddedVersion, segmentedVersion} {
+		data, err := set.encodeVersion(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeBackupSet(secrets, data)
+		if err != nil {
+			t.Fatal(version, err)
+		}
+		if decoded.tag != "foo" || len(decoded.records) != len(set.records) {
+			t.Error("Decoded version", version, "backup set", decoded.tag, "with", len(decoded.records), "records")
+		}
+		data[len(data)-49] ^= 1
+		_, err = decodeBackupSet(secrets, data)
+		if err == nil {
+			t.Error("Decoded corrupted version", version, "backup set")
+		}
+	}
+}
+
+// addRun adds a backup run with a single symlink to SET
+func addRun(t *testing.T, set *BackupSet, name string) {
+	err := set.StartBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.records = append(set.records, symLinkInfo{baseFileInfo{name: name, mode: os.ModeSymlink | 0777}, "target"})
+	err = set.EndBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rewritingBackend hides the AppendBackupSet method of its Backend
+type rewritingBackend struct {
+	Backend
+}
+
+func TestAppendBackupSet(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsId := secrets.HexId()
+	id := tagToId(secrets, "foo")
+	backend := memoryBackend.New()
+	set, err := EnsureBackupSet(backend, secrets, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRun(t, set, "/tmp/first")
+	err = set.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := backend.ReadBackupSet(secretsId, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err = ReadBackupSet(backend, secrets, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRun(t, set, "/tmp/second")
+	err = set.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := backend.ReadBackupSet(secretsId, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// everything but the HMAC is left as it was
+	if !bytes.Equal(second[:len(first)-48], first[:len(first)-48]) {
+		t.Error("Appending rewrote the existing backup set")
+	}
+	// and appending again, without re-reading, still works
+	addRun(t, set, "/tmp/third")
+	err = set.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err = ReadBackupSet(backend, secrets, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.records) != 9 || set.segments != 3 {
+		t.Error("Appended backup set has", len(set.records), "records in", set.segments, "segments")
+	}
+	err = verifyBackupSet(backend, secrets, id, make(map[string]bool))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// backends which cannot append get the whole set, under a new
+	// nonce
+	addRun(t, set, "/tmp/fourth")
+	err = set.Write(rewritingBackend{backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := backend.ReadBackupSet(secretsId, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(rewritten[1:49], first[1:49]) {
+		t.Error("Rewritten backup set has the same nonce")
+	}
+	set, err = ReadBackupSet(backend, secrets, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.records) != 12 || set.segments != 1 {
+		t.Error("Rewritten backup set has", len(set.records), "records in", set.segments, "segments")
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	base := func(name string, mode os.FileMode) baseFileInfo {
+		return baseFileInfo{name: name, mode: mode, uid: 1000, gid: 100,
+			userName: "alice", groupName: "users",
+			aTime: time.Unix(0, 1), mTime: time.Unix(0, 2), cTime: time.Unix(0, 3)}
+	}
+	withXattrs := base("/tmp/fifo", os.ModeNamedPipe|0600)
+	withXattrs.xattrs = []xattr{{"user.comment", []byte("a FIFO")}, {"user.empty", []byte{}}}
+	records := []fileRecord{
+		startRecord{date: time.Unix(1234567890, 0)},
+		directoryInfo{base("/tmp", os.ModeDir|0755)},
+		regularFileInfo{baseFileInfo: base("/tmp/file", 0644), size: 5, chunks: []string{strings.Repeat("ab", 48)}},
+		regularFileInfo{baseFileInfo: base("/tmp/sparse", 0644), size: 1 << 30, chunks: []string{strings.Repeat("cd", 48)},
+			extents: []extent{{4096, 4096}, {1<<30 - 512, 512}}},
+		hardLinkInfo{name: "/tmp/link", linkPath: "/tmp/file"},
+		fifoInfo{withXattrs},
+		symLinkInfo{base("/tmp/symlink", os.ModeSymlink|0777), "file"},
+		charDeviceInfo{deviceInfo{base("/tmp/null", os.ModeDevice|os.ModeCharDevice|0666), 0x103}},
+		blockDeviceInfo{deviceInfo{base("/tmp/sda", os.ModeDevice|0660), 0x800}},
+		errorRecord{name: "/tmp/unreadable", message: "permission denied"},
+		endRecord{make([]byte, 48)},
+	}
+	buffer := &bytes.Buffer{}
+	err := writeRecords(buffer, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := 0
+	for _, record := range records {
+		length += int(record.Len())
+	}
+	if length != buffer.Len() {
+		t.Error("Records are", buffer.Len(), "bytes long, but their lengths sum to", length)
+	}
+	var decoded []fileRecord
+	err = streamRecords(buffer, func(record fileRecord) error {
+		decoded = append(decoded, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(records) {
+		t.Fatal("Decoded", len(decoded), "of", len(records), "records")
+	}
+	for i := range records {
+		if !reflect.DeepEqual(records[i], decoded[i]) {
+			t.Errorf("Record %d was %#v, decoded as %#v", i, records[i], decoded[i])
+		}
+	}
+
+	// devices were written without their headers before version 2
+	_, data, err := records[7].Record()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := append([]byte{0, 6}, data...)
+	err = streamRecords(bytes.NewReader(old), func(fileRecord) error { return nil })
+	if err == nil {
+		t.Error("Decoded a version 0 device record")
+	}
+}
+
+func TestNarrowRecords(t *testing.T) {
+	file := regularFileInfo{baseFileInfo: baseFileInfo{name: "/tmp/file", mode: 0644,
+		aTime: time.Unix(0, 1), mTime: time.Unix(0, 2), cTime: time.Unix(0, 3)},
+		size: 5, chunks: []string{strings.Repeat("ef", 48)}}
+	base, err := file.baseFileInfo.Record()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// version 2 run lengths and chunk counts were 32 bits wide and
+	// chunk IDs were hex
+	old := &bytes.Buffer{}
+	old.Write([]byte{2, 0})
+	binary.Write(old, binary.BigEndian, int64(1234567890))
+	binary.Write(old, binary.BigEndian, uint32(1000))
+	old.Write([]byte{2, 3})
+	old.Write(base)
+	binary.Write(old, binary.BigEndian, file.size)
+	binary.Write(old, binary.BigEndian, uint32(1))
+	old.WriteString(file.chunks[0])
+	var decoded []fileRecord
+	err = streamRecords(old, func(record fileRecord) error {
+		decoded = append(decoded, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 {
+		t.Fatal("Decoded", len(decoded), "records")
+	}
+	if start := decoded[0].(startRecord); start.length != 1000 {
+		t.Error("Start record length decoded as", start.length)
+	}
+	if !reflect.DeepEqual(decoded[1], file) {
+		t.Errorf("Record was %#v, decoded as %#v", file, decoded[1])
+	}
+
+	// chunk IDs are now written in binary
+	file.chunks = []string{"not hex"}
+	err = writeRecords(&bytes.Buffer{}, []fileRecord{file})
+	if err == nil {
+		t.Error("Wrote an invalid chunk ID")
+	}
+}
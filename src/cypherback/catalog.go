@@ -0,0 +1,384 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+
+Catalog of backup sets
+
+Backup set IDs are HMACs of their tags, so the tags cannot be
+recovered from a listing.  The catalog, stored alongside the sets as
+"catalog" and sealed exactly as a run object is, records each set's
+tag.  Its plaintext is:
+
+Byte Length
+  0    1    version (1)
+  1    8    generation
+  9    4    number of entries
+ 13    -    entries, each:
+              4    tag length
+              -    tag
+             48    backup set ID
+              8    creation date
+              8    date of the last run
+              8    bytes of file data in the last run
+              4    number of runs
+
+The catalog is rewritten whole whenever a set is written, so it is
+always either the old or the new catalog, and its generation is
+increased each time.  A version 0 catalog has no generation, and is
+taken to be generation 0.  A set missing from it, for
+instance one written by an older client, is added when the catalog is
+read by decrypting the set's own header.
+
+*/
+
+const catalogId = "catalog"
+
+// A CatalogEntry describes a backup set.
+type CatalogEntry struct {
+	Tag     string
+	Id      string
+	Created time.Time
+	LastRun time.Time
+	// bytes of file data in the last run
+	Size int64
+	Runs int
+}
+
+// lastRunSize returns the bytes of file data in the last run in
+// RECORDS
+func lastRunSize(records []fileRecord) (size int64) {
+	for _, record := range records {
+		switch record := record.(type) {
+		case startRecord:
+			size = 0
+		case regularFileInfo:
+			size += record.size
+		case *regularFileInfo:
+			// as added by ProcessPath
+			size += record.size
+		}
+	}
+	return size
+}
+
+// encodeCatalog seals ENTRIES, as generation GENERATION, under SECRETS
+func encodeCatalog(secrets *Secrets, entries map[string]*CatalogEntry, generation uint64) ([]byte, error) {
+	plaintext := &bytes.Buffer{}
+	plaintext.WriteByte(1) // version
+	binary.Write(plaintext, binary.BigEndian, generation)
+	binary.Write(plaintext, binary.BigEndian, uint32(len(entries)))
+	for _, entry := range entries {
+		id, err := hex.DecodeString(entry.Id)
+		if err != nil || len(id) != 48 {
+			return nil, fmt.Errorf("Invalid backup set ID %s", entry.Id)
+		}
+		binary.Write(plaintext, binary.BigEndian, uint32(len(entry.Tag)))
+		plaintext.WriteString(entry.Tag)
+		plaintext.Write(id)
+		binary.Write(plaintext, binary.BigEndian, entry.Created.Unix())
+		binary.Write(plaintext, binary.BigEndian, entry.LastRun.Unix())
+		binary.Write(plaintext, binary.BigEndian, entry.Size)
+		binary.Write(plaintext, binary.BigEndian, uint32(entry.Runs))
+	}
+	return sealMetadata(secrets, plaintext.Bytes(), padRandom)
+}
+
+// decodeCatalog authenticates and decrypts the catalog DATA, returning
+// its entries by set ID and its generation
+func decodeCatalog(secrets *Secrets, data []byte) (entries map[string]*CatalogEntry, generation uint64, err error) {
+	plaintext, err := openMetadata(secrets, data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Catalog: %v", err)
+	}
+	reader := bytes.NewReader(plaintext)
+	var version uint8
+	var count uint32
+	err = binary.Read(reader, binary.BigEndian, &version)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > 1 {
+		return nil, 0, fmt.Errorf("Unsupported catalog version %d", version)
+	}
+	if version == 1 {
+		err = binary.Read(reader, binary.BigEndian, &generation)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	err = binary.Read(reader, binary.BigEndian, &count)
+	if err != nil {
+		return nil, 0, err
+	}
+	entries = make(map[string]*CatalogEntry)
+	for i := uint32(0); i < count; i++ {
+		var tagLen uint32
+		err = binary.Read(reader, binary.BigEndian, &tagLen)
+		if err != nil {
+			return nil, 0, err
+		}
+		if uint64(tagLen) > uint64(reader.Len()) {
+			return nil, 0, fmt.Errorf("Catalog entry %d is truncated", i)
+		}
+		tag, err := readLenString(reader, tagLen)
+		if err != nil {
+			return nil, 0, err
+		}
+		id := make([]byte, 48)
+		_, err = io.ReadFull(reader, id)
+		if err != nil {
+			return nil, 0, err
+		}
+		var created, lastRun int64
+		var runs uint32
+		entry := &CatalogEntry{Tag: tag, Id: hex.EncodeToString(id)}
+		err = binary.Read(reader, binary.BigEndian, &created)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = binary.Read(reader, binary.BigEndian, &lastRun)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = binary.Read(reader, binary.BigEndian, &entry.Size)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = binary.Read(reader, binary.BigEndian, &runs)
+		if err != nil {
+			return nil, 0, err
+		}
+		entry.Created = time.Unix(created, 0)
+		entry.LastRun = time.Unix(lastRun, 0)
+		entry.Runs = int(runs)
+		entries[entry.Id] = entry
+	}
+	return entries, generation, nil
+}
+
+// readCatalog reads the catalog of SECRETS, which is empty if there is
+// none yet, and its generation
+func readCatalog(backend Backend, secrets *Secrets) (entries map[string]*CatalogEntry, generation uint64, err error) {
+	data, err := backend.ReadBackupSet(secrets.HexId(), catalogId)
+	if os.IsNotExist(err) {
+		entries = make(map[string]*CatalogEntry)
+	} else if err != nil {
+		return nil, 0, err
+	} else {
+		entries, generation, err = decodeCatalog(secrets, data)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	err = generationCache.check(secrets.HexId(), catalogId, generation)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, generation, nil
+}
+
+// writeCatalog replaces the catalog of SECRETS, of generation
+// GENERATION, with ENTRIES
+func writeCatalog(backend Backend, secrets *Secrets, entries map[string]*CatalogEntry, generation uint64) error {
+	secretsId := secrets.HexId()
+	generation = generationCache.next(secretsId, catalogId, generation)
+	data, err := encodeCatalog(secrets, entries, generation)
+	if err != nil {
+		return err
+	}
+	err = backend.WriteBackupSet(secretsId, catalogId, data)
+	if err != nil {
+		return err
+	}
+	return generationCache.check(secretsId, catalogId, generation)
+}
+
+// updateCatalog records the state of B, which has just been written,
+// in the catalog
+func (b *BackupSet) updateCatalog(backend Backend, lastRunSize int64, newRun bool) error {
+	entries, generation, err := readCatalog(backend, b.secrets)
+	if err != nil {
+		return err
+	}
+	id := tagToId(b.secrets, b.tag)
+	entry, ok := entries[id]
+	if !ok {
+		entry = &CatalogEntry{Tag: b.tag, Id: id, Created: time.Now()}
+		entries[id] = entry
+		newRun = true
+	}
+	entry.Runs = len(b.runs)
+	if len(b.runs) > 0 {
+		entry.LastRun = b.runs[len(b.runs)-1].date
+	}
+	if newRun {
+		entry.Size = lastRunSize
+	}
+	return writeCatalog(backend, b.secrets, entries, generation)
+}
+
+// catalogEntryFor describes the backup set ID, which the catalog does
+// not know, by reading it
+func catalogEntryFor(backend Backend, secrets *Secrets, id string) (*CatalogEntry, error) {
+	set, err := readBackupSet(backend, secrets, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(set.runs) > 0 {
+		err = set.loadRuns(backend, set.runs[len(set.runs)-1:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	entry := &CatalogEntry{Tag: set.tag, Id: id, Size: lastRunSize(set.records)}
+	for _, record := range set.records {
+		if start, ok := record.(startRecord); ok {
+			if len(set.runs) == 0 {
+				entry.Runs++
+				if entry.Created.IsZero() {
+					entry.Created = start.date
+				}
+			}
+			entry.LastRun = start.date
+		}
+	}
+	if len(set.runs) > 0 {
+		entry.Runs = len(set.runs)
+		entry.Created = set.runs[0].date
+	}
+	return entry, nil
+}
+
+// ReadCatalog returns the backup sets of SECRETS, sorted by tag.  Sets
+// which the catalog does not know are read to find their tags, and
+// the catalog is updated if any are found.
+func ReadCatalog(backend Backend, secrets *Secrets) ([]CatalogEntry, error) {
+	entries, generation, err := readCatalog(backend, secrets)
+	if err != nil {
+		return nil, err
+	}
+	setIds, err := listBackupSets(backend, secrets.HexId())
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	exists := make(map[string]bool)
+	for _, id := range setIds {
+		exists[id] = true
+		if _, ok := entries[id]; ok {
+			continue
+		}
+		entry, err := catalogEntryFor(backend, secrets, id)
+		if isStale(err) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Backup set %s: %v", id, err)
+		}
+		entries[id] = entry
+		changed = true
+	}
+	for id := range entries {
+		if !exists[id] {
+			delete(entries, id)
+			changed = true
+		}
+	}
+	if changed {
+		err = writeCatalog(backend, secrets, entries, generation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var catalog []CatalogEntry
+	for _, entry := range entries {
+		catalog = append(catalog, *entry)
+	}
+	sort.Sort(byTag(catalog))
+	return catalog, nil
+}
+
+type byTag []CatalogEntry
+
+func (c byTag) Len() int           { return len(c) }
+func (c byTag) Less(i, j int) bool { return c[i].Tag < c[j].Tag }
+func (c byTag) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// RenameBackupSet re-tags the backup set OLDTAG as NEWTAG.  Since a
+// set's ID and its runs' names depend on its tag, the set is written
+// afresh under the new tag before the old one is removed.
+func RenameBackupSet(backend Backend, secrets *Secrets, oldTag, newTag string) error {
+	_, err := backend.ReadBackupSet(secrets.HexId(), tagToId(secrets, newTag))
+	if err == nil {
+		return fmt.Errorf("Backup set %s already exists", newTag)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	set, err := ReadBackupSet(backend, secrets, oldTag)
+	if err != nil {
+		return err
+	}
+	renamed := &BackupSet{tag: newTag, secrets: secrets, records: set.records, padding: set.padding}
+	err = renamed.writeMetadata(backend)
+	if err != nil {
+		return err
+	}
+	return RemoveBackupSet(backend, secrets, oldTag)
+}
+
+// RemoveBackupSet deletes the backup set tagged TAG and all its runs.
+// The chunks to which it referred remain until CollectGarbage is run.
+func RemoveBackupSet(backend Backend, secrets *Secrets, tag string) error {
+	secretsId := secrets.HexId()
+	id := tagToId(secrets, tag)
+	set, err := readBackupSet(backend, secrets, id)
+	if err != nil {
+		return err
+	}
+	// the index goes first, so that its runs are never missing
+	err = backend.DeleteBackupSet(secretsId, id)
+	if err != nil {
+		return err
+	}
+	for _, run := range set.runs {
+		err = backend.DeleteBackupSet(secretsId, runObjectId(id, run.id))
+		if err != nil {
+			return err
+		}
+	}
+	entries, generation, err := readCatalog(backend, secrets)
+	if err != nil {
+		return err
+	}
+	delete(entries, id)
+	return writeCatalog(backend, secrets, entries, generation)
+}
@@ -0,0 +1,169 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	memoryBackend "cypherback/backends/memory"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "file"), []byte("some file contents"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsId := secrets.HexId()
+	backend := memoryBackend.New()
+	for i := 0; i < 2; i++ {
+		set, err := EnsureBackupSet(backend, secrets, "files")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = set.StartBackup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ProcessPath(set, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = set.EndBackup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = set.Write(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a set written without the catalog knowing
+	old, err := newBackupSet("old", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRun(t, old, "/tmp/old")
+	data, err := old.encodeVersion(paddedVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.WriteBackupSet(secretsId, tagToId(secrets, "old"), data)
+
+	catalog, err := ReadCatalog(backend, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog) != 2 {
+		t.Fatal("Catalog is", catalog)
+	}
+	if catalog[0].Tag != "files" || catalog[0].Runs != 2 || catalog[0].Size != 18 || catalog[0].Id != tagToId(secrets, "files") {
+		t.Error("Catalog entry is", catalog[0])
+	}
+	if catalog[1].Tag != "old" || catalog[1].Runs != 1 {
+		t.Error("Catalog entry is", catalog[1])
+	}
+	setIds, err := listBackupSets(backend, secretsId)
+	if err != nil || len(setIds) != 2 {
+		t.Error("Listed backup sets", setIds, err)
+	}
+
+	err = RenameBackupSet(backend, secrets, "files", "old")
+	if err == nil {
+		t.Error("Renamed a backup set over another")
+	}
+	err = RenameBackupSet(backend, secrets, "files", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := ReadBackupSet(backend, secrets, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.tag != "new" || len(set.runs) != 2 || len(set.records) != len(old.records)*2+2 {
+		t.Error("Renamed backup set", set.tag, "has", len(set.runs), "runs and", len(set.records), "records")
+	}
+	err = RemoveBackupSet(backend, secrets, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err = ReadCatalog(backend, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog) != 1 || catalog[0].Tag != "new" || catalog[0].Runs != 2 {
+		t.Error("Catalog is", catalog)
+	}
+	ids, err := backend.ListBackupSets(secretsId)
+	if err != nil || len(ids) != 4 {
+		t.Error("Stored", ids, err)
+	}
+}
+
+// unreadableBackend fails to read any backup set, as a backend which
+// has lost its connection would
+type unreadableBackend struct {
+	Backend
+}
+
+var errUnreadable = fmt.Errorf("Connection reset")
+
+func (ub unreadableBackend) ReadBackupSet(secretsId, id string) ([]byte, error) {
+	return nil, errUnreadable
+}
+
+func TestUnreadableBackupSets(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := memoryBackend.New()
+	_, err = backend.ReadBackupSet(secrets.HexId(), catalogId)
+	if !os.IsNotExist(err) {
+		t.Error("Read a missing backup set:", err)
+	}
+	_, err = ReadCatalog(backend, secrets)
+	if err != nil {
+		t.Error("Read a missing catalog:", err)
+	}
+	_, err = ReadCatalog(unreadableBackend{backend}, secrets)
+	if err != errUnreadable {
+		t.Error("Read an unreadable catalog:", err)
+	}
+	_, err = EnsureBackupSet(unreadableBackend{backend}, secrets, "foo")
+	if err != errUnreadable {
+		t.Error("Ensured an unreadable backup set:", err)
+	}
+	err = ListBackupSet(unreadableBackend{backend}, secrets, "foo", 0, ioutil.Discard)
+	if err != errUnreadable {
+		t.Error("Listed an unreadable backup set:", err)
+	}
+}
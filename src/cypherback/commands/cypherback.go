@@ -21,13 +21,21 @@ import (
 	"cypherback"
 	//fileBackend "cypherback/backends/file"
 	s3Backend "cypherback/backends/s3"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 var exitCode int
 
+// exitWarnings is the exit code of a backup or restore which
+// completed, but without some files or some of their attributes
+const exitWarnings = 2
+
 func die(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, args...)
 	os.Exit(1)
@@ -35,17 +43,91 @@ func die(format string, args ...interface{}) {
 
 func usage() {
 	fmt.Fprintf(os.Stderr, `Usage:
-  cypherback secrets generate [--plaintext-tag TAG]
-    Generate a new secrets file
+  cypherback secrets generate [--kdf KDF] [--plaintext-tag TAG]
+    Generate a new secrets file; KDF is scrypt (the default) or pbkdf2.
+    TAG is a plaintext label to help tell secrets files apart
+
+  cypherback secrets upgrade-kdf [--kdf KDF]
+    Re-encrypt the secrets file under a new passphrase and KDF,
+    re-tuning the KDF's cost for this machine
+
+  cypherback secrets list
+    List secrets files; > marks the one in use, * the default
+
+  cypherback secrets use ID
+    Use the secrets file ID (an ID, unique ID prefix or label) from now on
+
+  cypherback secrets set-default ID
+    Make the secrets file ID the default for everyone using the backend
+
+  cypherback secrets export [--fingerprint] [ID]
+    Print the (still encrypted) secrets file as ASCII-armoured text for
+    offline storage, optionally with a fingerprint of its ID
+
+  cypherback secrets import [FILE]
+    Validate and install ASCII-armoured secrets from FILE or stdin
+
+  cypherback secrets split --shares N --threshold K
+    Print N armoured shares of the keys, any K of which can recover them
+
+  cypherback secrets combine [--kdf KDF] [--plaintext-tag TAG] [FILE…]
+    Recover the keys from shares in FILEs or stdin and write a fresh
+    secrets file under a new passphrase
+
+  cypherback secrets rotate [--kdf KDF]
+    Generate new secrets, re-encrypt every backup set and chunk under
+    them and then delete the old secrets and everything stored under
+    them.  An interrupted rotation is resumed by running this again
+
+  cypherback backup [--compression METHOD] [--padding SCHEME]
+                    [--xattr-include LIST] [--xattr-exclude LIST]
+                    [--exclude PATTERN]… [--exclude-from FILE]
+                    [--one-file-system] [--exclude-caches]
+                    [--max-file-size SIZE] [--verbose] TAG PATH…
+    Create a new backup set, or append to the existing backup set TAG.
+    METHOD is auto (the default), deflate, lzw or none; SCHEME is
+    random (the default), pow2 or none.  LISTs are comma-separated
+    extended attribute namespaces (such as user) or names (such as
+    security.capability) to back up, or not; all are by default.
+    Files matching a gitignore-style PATTERN, one in FILE or one in a
+    .cypherbackignore file are skipped, as are directories on other
+    filesystems than PATH, the contents of directories tagged with a
+    CACHEDIR.TAG and files over SIZE (such as 100M), if asked.
+    --verbose reports each file skipped and why.  Files which cannot
+    be read are reported and recorded in the backup set, and the rest
+    are backed up; cypherback then exits with status 2
+
+  cypherback check
+    Verify every backup set and every chunk to which they refer
+
+  cypherback gc
+    Delete chunks which no backup set refers to, and repack packs
+    which are mostly empty.  No backup may run at the same time
+
+  cypherback sets [list]
+    List backup sets, with their runs, last run and size
+
+  cypherback sets rename TAG NEWTAG
+    Re-tag backup set TAG as NEWTAG
+
+  cypherback sets delete TAG
+    Delete backup set TAG; run gc afterwards to delete its chunks
 
-  cypherback backup TAG PATH…
-    Create a new backup set, or append to the existing backup set TAG
+  cypherback list [--runs N] TAG
+    List contents of backup set TAG, or of only its N most recent runs
 
-  cypherback list TAG
-    List contents of backup set TAG 
+  cypherback prune TAG N
+    Delete all but the N most recent runs of backup set TAG; run gc
+    afterwards to delete the chunks only they used
 
-  cypherback restore TAG
-    Restore backup set TAG
+  cypherback restore [--owners POLICY] [--map-user OLD:NEW]…
+                     [--map-group OLD:NEW]… TAG
+    Restore backup set TAG.  When run as root, files are given their
+    owners: POLICY is names (the default), to use the users and groups
+    of the same names here, or numeric, to use the recorded IDs.  A
+    mapping gives files owned by the user or group OLD (a name or ID)
+    to NEW instead.  Files whose owners, modes or times cannot be
+    restored are reported, and restoring continues
 `)
 	exitCode = 1
 }
@@ -59,6 +141,70 @@ func logError(format string, args ...interface{}) {
 	exitCode = 1
 }
 
+// logWarning logs a problem which did not stop a command completing
+func logWarning(format string, args ...interface{}) {
+	log.Printf("Warning: "+format+"\n", args...)
+	if exitCode == 0 {
+		exitCode = exitWarnings
+	}
+}
+
+// ownerMappings collects repeated --map-user or --map-group flags
+type ownerMappings map[string]string
+
+func (m ownerMappings) String() string {
+	return ""
+}
+
+func (m ownerMappings) Set(mapping string) error {
+	return cypherback.AddOwnerMapping(m, mapping)
+}
+
+// patternList collects repeated --exclude flags
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(pattern string) error {
+	*l = append(*l, pattern)
+	return nil
+}
+
+// config holds the settings read from cypherback.conf
+var config map[string]string
+
+// configBool returns the boolean configured as NAME, or false if it is
+// unset
+func configBool(name string) bool {
+	value := config[name]
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s %q", name, value)
+		return false
+	}
+	return b
+}
+
+// packSize returns the pack size configured in MiB as pack_size, or
+// zero if chunks shouldn't be packed
+func packSize() int {
+	size := config["pack_size"]
+	if size == "" {
+		return 0
+	}
+	mib, err := strconv.ParseFloat(size, 64)
+	if err != nil || mib < 0 {
+		log.Printf("Ignoring invalid pack_size %q", size)
+		return 0
+	}
+	return int(mib * (1 << 20))
+}
+
 func main() {
 	defer exit()
 
@@ -71,7 +217,18 @@ func main() {
 		logError("Couldn't ensure configuration directory exists: %s", err)
 		return
 	}
-	_ = configDir
+	config, err = cypherback.ReadConfig(filepath.Join(configDir, "cypherback.conf"))
+	if err != nil {
+		logError("Couldn't read configuration: %s", err)
+		return
+	}
+	generations, err := cypherback.OpenGenerationCache(filepath.Join(configDir, "generations"))
+	if err != nil {
+		logError("Couldn't read generation cache: %s", err)
+		return
+	}
+	cypherback.UseGenerationCache(generations)
+	secretsId := currentSecretsId(configDir)
 	//backend := fileBackend.NewFileBackend(configDir)
 	backend, err := s3Backend.New(os.Getenv("s3_access_key"), 
 		os.Getenv("s3_secret_key"),
@@ -83,38 +240,101 @@ func main() {
 	}
 	switch os.Args[1] {
 	case "secrets":
-		if len(os.Args) < 3 {
-			usage()
-			return
+		secretsCommand(backend, configDir, os.Args[2:])
+	case "sets":
+		setsCommand(backend, secretsId, os.Args[2:])
+	case "backup":
+		flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+		flags.Usage = usage
+		defaultCompression := config["compression"]
+		if defaultCompression == "" {
+			defaultCompression = "auto"
 		}
-		if os.Args[2] == "generate" {
-			secrets, err := cypherback.GenerateSecrets(backend)
-			defer cypherback.ZeroSecrets(secrets)
-			if err != nil {
-				logError("Error: %v", err)
-				return
+		compression := flags.String("compression", defaultCompression, "chunk compression")
+		defaultPadding := config["padding"]
+		if defaultPadding == "" {
+			defaultPadding = "random"
+		}
+		padding := flags.String("padding", defaultPadding, "chunk and backup set padding")
+		xattrInclude := flags.String("xattr-include", config["xattr_include"], "extended attributes to back up")
+		xattrExclude := flags.String("xattr-exclude", config["xattr_exclude"], "extended attributes not to back up")
+		var excludes patternList
+		for _, pattern := range strings.Split(config["exclude"], ",") {
+			if pattern != "" {
+				excludes = append(excludes, pattern)
 			}
-		} else {
-			logError("Unknown secrets command %s", os.Args[2])
+		}
+		flags.Var(&excludes, "exclude", "pattern of files not to back up")
+		excludeFrom := flags.String("exclude-from", config["exclude_from"], "file of patterns of files not to back up")
+		oneFileSystem := flags.Bool("one-file-system", configBool("one_file_system"), "stay on each path's filesystem")
+		excludeCaches := flags.Bool("exclude-caches", configBool("exclude_caches"), "skip the contents of tagged cache directories")
+		maxFileSize := flags.String("max-file-size", config["max_file_size"], "size of the largest file to back up")
+		verbose := flags.Bool("verbose", false, "report skipped files")
+		if flags.Parse(os.Args[2:]) != nil {
 			return
 		}
-	case "backup":
-		if len(os.Args) < 4 {
+		if flags.NArg() < 2 {
 			usage()
 			return
 		}
-		tag := os.Args[2]
+		tag := flags.Arg(0)
 		var paths []string
-		paths = append(paths, os.Args[3:]...)
+		paths = append(paths, flags.Args()[1:]...)
 
-		secrets, err := cypherback.ReadSecrets(backend)
+		secrets, err := readSecrets(backend, secretsId)
 		defer cypherback.ZeroSecrets(secrets)
 		if err != nil {
 			logError("Error: %v", err)
 			return
 		}
+		packs := cypherback.NewPackBackend(backend, packSize(), secrets)
 
-		backupSet, err := cypherback.EnsureBackupSet(backend, secrets, tag)
+		backupSet, err := cypherback.EnsureBackupSet(packs, secrets, tag)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		err = backupSet.SetCompression(*compression)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		err = backupSet.SetPadding(*padding)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		err = backupSet.SetXattrFilter(*xattrInclude, *xattrExclude)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		excludeOptions := &cypherback.ExcludeOptions{
+			Patterns:      excludes,
+			OneFileSystem: *oneFileSystem,
+			ExcludeCaches: *excludeCaches,
+		}
+		if *excludeFrom != "" {
+			patterns, err := cypherback.ReadExcludeFile(*excludeFrom)
+			if err != nil {
+				logError("Error: %v", err)
+				return
+			}
+			excludeOptions.Patterns = append(excludeOptions.Patterns, patterns...)
+		}
+		if *maxFileSize != "" {
+			excludeOptions.MaxFileSize, err = cypherback.ParseSize(*maxFileSize)
+			if err != nil {
+				logError("Error: %v", err)
+				return
+			}
+		}
+		if *verbose {
+			excludeOptions.Report = func(path, reason string) {
+				log.Printf("Skipped %s: %s", path, reason)
+			}
+		}
+		err = backupSet.SetExcludeOptions(excludeOptions)
 		if err != nil {
 			logError("Error: %v", err)
 			return
@@ -137,49 +357,121 @@ func main() {
 			logError("Error: %v", err)
 			return
 		}
-		err = backupSet.Write(backend)
+		err = backupSet.Write(packs)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		for _, err := range backupSet.FileErrors() {
+			logWarning("%v", err)
+		}
+	case "check", "gc":
+		if len(os.Args) != 2 {
+			usage()
+			return
+		}
+		secrets, err := readSecrets(backend, secretsId)
+		defer cypherback.ZeroSecrets(secrets)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		packs := cypherback.NewPackBackend(backend, packSize(), secrets)
+		if os.Args[1] == "check" {
+			err = cypherback.CheckBackupSets(packs, secrets, os.Stderr)
+		} else {
+			err = cypherback.CollectGarbage(packs, secrets, os.Stderr)
+		}
 		if err != nil {
 			logError("Error: %v", err)
 			return
 		}
 	case "list":
-		if len(os.Args) < 3 {
+		flags := flag.NewFlagSet("list", flag.ContinueOnError)
+		flags.Usage = usage
+		runs := flags.Int("runs", 0, "number of runs to list")
+		if flags.Parse(os.Args[2:]) != nil {
+			return
+		}
+		if flags.NArg() != 1 {
 			usage()
 			return
 		}
-		tag := os.Args[2]
+		tag := flags.Arg(0)
 
-		secrets, err := cypherback.ReadSecrets(backend)
+		secrets, err := readSecrets(backend, secretsId)
 		defer cypherback.ZeroSecrets(secrets)
 		if err != nil {
 			logError("Error: %v", err)
 			return
 		}
-		backupSet, err := cypherback.ReadBackupSet(backend, secrets, tag)
+		packs := cypherback.NewPackBackend(backend, packSize(), secrets)
+		err = cypherback.ListBackupSet(packs, secrets, tag, *runs, os.Stdout)
 		if err != nil {
 			logError("Error: %v", err)
 			return
 		}
-		backupSet.ListRecords()
-	case "restore":
-		if len(os.Args) < 3 {
+	case "prune":
+		if len(os.Args) != 4 {
 			usage()
 			return
 		}
 		tag := os.Args[2]
-
-		secrets, err := cypherback.ReadSecrets(backend)
+		keep, err := strconv.Atoi(os.Args[3])
+		if err != nil {
+			logError("Invalid number of runs %s", os.Args[3])
+			return
+		}
+		secrets, err := readSecrets(backend, secretsId)
 		defer cypherback.ZeroSecrets(secrets)
 		if err != nil {
 			logError("Error: %v", err)
 			return
 		}
-		backupSet, err := cypherback.ReadBackupSet(backend, secrets, tag)
+		pruned, err := cypherback.PruneBackupSet(backend, secrets, tag, keep)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Deleted %d runs\n", pruned)
+	case "restore":
+		flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+		flags.Usage = usage
+		owners := flags.String("owners", "names", "how owners are restored: names or numeric")
+		userMap := ownerMappings{}
+		groupMap := ownerMappings{}
+		flags.Var(userMap, "map-user", "OLD:NEW user mapping")
+		flags.Var(groupMap, "map-group", "OLD:NEW group mapping")
+		if flags.Parse(os.Args[2:]) != nil {
+			return
+		}
+		if flags.NArg() != 1 {
+			usage()
+			return
+		}
+		tag := flags.Arg(0)
+		policy, err := cypherback.ParseOwnerPolicy(*owners)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		options := &cypherback.RestoreOptions{
+			Owners:   policy,
+			UserMap:  userMap,
+			GroupMap: groupMap,
+			Report: func(path string, err error) {
+				logWarning("%s: %v", path, err)
+			},
+		}
+
+		secrets, err := readSecrets(backend, secretsId)
+		defer cypherback.ZeroSecrets(secrets)
 		if err != nil {
 			logError("Error: %v", err)
 			return
 		}
-		err = backupSet.Restore(backend)
+		packs := cypherback.NewPackBackend(backend, packSize(), secrets)
+		err = cypherback.RestoreBackupSet(packs, secrets, tag, options)
 		if err != nil {
 			logError("Error: %v", err)
 			return
@@ -0,0 +1,343 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"cypherback"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// currentSecretsId returns the ID of the secrets file selected with
+// 'cypherback secrets use', or the empty string to use the default.
+func currentSecretsId(configDir string) string {
+	id, err := ioutil.ReadFile(filepath.Join(configDir, "currentSecrets"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
+
+func useSecrets(configDir, id string) error {
+	return ioutil.WriteFile(filepath.Join(configDir, "currentSecrets"), []byte(id+"\n"), 0600)
+}
+
+// readSecrets reads the secrets file ID, or the default one, advising
+// the user to re-tune it if it is outdated or unlocking it took much
+// more or less time than it should
+func readSecrets(backend cypherback.Backend, id string) (*cypherback.Secrets, error) {
+	secrets, unlock, err := cypherback.ReadSecrets(backend, id)
+	if err != nil {
+		return nil, err
+	}
+	if unlock.Outdated {
+		log.Printf("The secrets file is of an old version; run 'cypherback secrets upgrade-kdf' to rewrite it")
+	} else if unlock.NeedsRetune() {
+		log.Printf("Unlocking the secrets file took %s; run 'cypherback secrets upgrade-kdf' to re-tune it from %s to about %s", unlock.Elapsed, unlock.KDF, unlock.Suggested())
+	}
+	return secrets, nil
+}
+
+// calibratedKDF returns the KDF named NAME, tuned for this machine
+func calibratedKDF(name string) (cypherback.KDF, error) {
+	kdf, err := cypherback.NewKDF(name)
+	if err != nil {
+		return nil, err
+	}
+	return cypherback.CalibrateKDF(kdf)
+}
+
+func secretsCommand(backend cypherback.Backend, configDir string, args []string) {
+	if len(args) < 1 {
+		usage()
+		return
+	}
+	flags := flag.NewFlagSet("secrets "+args[0], flag.ContinueOnError)
+	flags.Usage = usage
+	switch args[0] {
+	case "generate":
+		kdfName := flags.String("kdf", "scrypt", "key derivation function")
+		label := flags.String("plaintext-tag", "", "plaintext label")
+		if flags.Parse(args[1:]) != nil {
+			return
+		}
+		kdf, err := calibratedKDF(*kdfName)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		secrets, err := cypherback.GenerateSecrets(backend, kdf, *label)
+		defer cypherback.ZeroSecrets(secrets)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		fmt.Println(secrets.HexId())
+	case "upgrade-kdf":
+		kdfName := flags.String("kdf", "scrypt", "key derivation function")
+		if flags.Parse(args[1:]) != nil {
+			return
+		}
+		kdf, err := calibratedKDF(*kdfName)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		secrets, _, err := cypherback.ReadSecrets(backend, currentSecretsId(configDir))
+		defer cypherback.ZeroSecrets(secrets)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		err = cypherback.RewrapSecrets(backend, secrets, kdf)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+	case "list":
+		infos, err := cypherback.ListSecrets(backend)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		current := currentSecretsId(configDir)
+		for _, info := range infos {
+			marker := " "
+			switch {
+			case info.Id == current:
+				marker = ">"
+			case current == "" && info.Default:
+				marker = ">"
+			}
+			if info.Default {
+				marker += "*"
+			} else {
+				marker += " "
+			}
+			fmt.Printf("%s %s %s\t%s\n", marker, info.Id, info.Label, info.KDF)
+		}
+	case "use", "set-default":
+		if len(args) < 2 {
+			usage()
+			return
+		}
+		id, err := cypherback.ResolveSecretsId(backend, args[1])
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		if args[0] == "use" {
+			err = useSecrets(configDir, id)
+		} else {
+			err = backend.SetDefaultSecrets(id)
+		}
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+	case "export":
+		fingerprint := flags.Bool("fingerprint", false, "include a fingerprint")
+		if flags.Parse(args[1:]) != nil {
+			return
+		}
+		id := currentSecretsId(configDir)
+		if flags.NArg() > 0 {
+			var err error
+			id, err = cypherback.ResolveSecretsId(backend, flags.Arg(0))
+			if err != nil {
+				logError("Error: %v", err)
+				return
+			}
+		}
+		err := cypherback.ExportSecrets(backend, id, os.Stdout, *fingerprint)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+	case "import":
+		input := os.Stdin
+		if len(args) > 1 {
+			file, err := os.Open(args[1])
+			if err != nil {
+				logError("Error: %v", err)
+				return
+			}
+			defer file.Close()
+			input = file
+		}
+		secrets, err := cypherback.ImportSecrets(backend, input)
+		defer cypherback.ZeroSecrets(secrets)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		fmt.Println(secrets.HexId())
+	case "split":
+		shares := flags.Int("shares", 0, "number of shares")
+		threshold := flags.Int("threshold", 0, "number of shares needed to recover the keys")
+		if flags.Parse(args[1:]) != nil {
+			return
+		}
+		secrets, err := readSecrets(backend, currentSecretsId(configDir))
+		defer cypherback.ZeroSecrets(secrets)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		err = cypherback.SplitSecrets(secrets, *shares, *threshold, os.Stdout)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+	case "combine":
+		kdfName := flags.String("kdf", "scrypt", "key derivation function")
+		label := flags.String("plaintext-tag", "", "plaintext label")
+		if flags.Parse(args[1:]) != nil {
+			return
+		}
+		var inputs []io.Reader
+		for _, path := range flags.Args() {
+			file, err := os.Open(path)
+			if err != nil {
+				logError("Error: %v", err)
+				return
+			}
+			defer file.Close()
+			inputs = append(inputs, file)
+		}
+		if len(inputs) == 0 {
+			inputs = append(inputs, os.Stdin)
+		}
+		secrets, err := cypherback.CombineShares(io.MultiReader(inputs...))
+		defer cypherback.ZeroSecrets(secrets)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		kdf, err := calibratedKDF(*kdfName)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		secrets.SetLabel(*label)
+		err = cypherback.RewrapSecrets(backend, secrets, kdf)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		fmt.Println(secrets.HexId())
+	case "rotate":
+		kdfName := flags.String("kdf", "scrypt", "key derivation function")
+		if flags.Parse(args[1:]) != nil {
+			return
+		}
+		err := rotateSecrets(backend, configDir, *kdfName)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+	default:
+		logError("Unknown secrets command %s", args[0])
+	}
+}
+
+// rotateSecrets generates new secrets and re-encrypts everything
+// stored under the current secrets with them, then retires the old
+// secrets.  The IDs of both are recorded in configDir/rotation until
+// the rotation is complete, so that an interrupted rotation is resumed
+// rather than started afresh.
+func rotateSecrets(backend cypherback.Backend, configDir, kdfName string) error {
+	statePath := filepath.Join(configDir, "rotation")
+	var oldSecrets, newSecrets *cypherback.Secrets
+	var oldId, newId string
+	defer func() {
+		cypherback.ZeroSecrets(oldSecrets)
+		cypherback.ZeroSecrets(newSecrets)
+	}()
+	state, err := ioutil.ReadFile(statePath)
+	switch {
+	case err == nil:
+		ids := strings.Fields(string(state))
+		if len(ids) != 2 {
+			return fmt.Errorf("Malformed rotation state file %s", statePath)
+		}
+		oldId, newId = ids[0], ids[1]
+		fmt.Fprintf(os.Stderr, "Resuming rotation from %s to %s\n", oldId, newId)
+		_, err = backend.ReadSecretsById(oldId)
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "Passphrase for the old secrets %s\n", oldId)
+			oldSecrets, err = readSecrets(backend, oldId)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Passphrase for the new secrets %s\n", newId)
+			newSecrets, err = readSecrets(backend, newId)
+			if err != nil {
+				return err
+			}
+		}
+	case os.IsNotExist(err):
+		oldSecrets, err = readSecrets(backend, currentSecretsId(configDir))
+		if err != nil {
+			return err
+		}
+		kdf, err := calibratedKDF(kdfName)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Choose a passphrase for the new secrets")
+		newSecrets, err = cypherback.GenerateSecrets(backend, kdf, oldSecrets.Label())
+		if err != nil {
+			return err
+		}
+		oldId, newId = oldSecrets.HexId(), newSecrets.HexId()
+		err = ioutil.WriteFile(statePath, []byte(oldId+" "+newId+"\n"), 0600)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	// the old secrets file is deleted last, so if it is gone an
+	// earlier run got as far as retiring it
+	if oldSecrets != nil {
+		packs := cypherback.NewPackBackend(backend, packSize(), oldSecrets, newSecrets)
+		err = cypherback.RotateSecrets(packs, oldSecrets, newSecrets, os.Stderr)
+		if err != nil {
+			return err
+		}
+		err = cypherback.RetireSecrets(backend, oldId, newId)
+		if err != nil {
+			return err
+		}
+	}
+	if currentSecretsId(configDir) == oldId {
+		err = useSecrets(configDir, newId)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Println(newId)
+	return os.Remove(statePath)
+}
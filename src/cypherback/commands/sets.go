@@ -0,0 +1,86 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"cypherback"
+	"fmt"
+	"time"
+)
+
+func setsCommand(backend cypherback.Backend, secretsId string, args []string) {
+	command := "list"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "list":
+		if len(args) > 1 {
+			usage()
+			return
+		}
+		secrets, err := readSecrets(backend, secretsId)
+		defer cypherback.ZeroSecrets(secrets)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		catalog, err := cypherback.ReadCatalog(backend, secrets)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		for _, entry := range catalog {
+			fmt.Printf("%s\t%d runs\tlast %s\t%d bytes\n", entry.Tag, entry.Runs, entry.LastRun.Format(time.RFC3339), entry.Size)
+		}
+	case "rename":
+		if len(args) != 3 {
+			usage()
+			return
+		}
+		secrets, err := readSecrets(backend, secretsId)
+		defer cypherback.ZeroSecrets(secrets)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		err = cypherback.RenameBackupSet(backend, secrets, args[1], args[2])
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+	case "delete":
+		if len(args) != 2 {
+			usage()
+			return
+		}
+		secrets, err := readSecrets(backend, secretsId)
+		defer cypherback.ZeroSecrets(secrets)
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+		err = cypherback.RemoveBackupSet(backend, secrets, args[1])
+		if err != nil {
+			logError("Error: %v", err)
+			return
+		}
+	default:
+		usage()
+	}
+}
@@ -18,10 +18,12 @@
 package cypherback
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 )
 
 func EnsureConfigDir() (path string, err error) {
@@ -55,3 +57,44 @@ func EnsureConfigDir() (path string, err error) {
 	}
 	return configdir, nil
 }
+
+// ReadConfig reads the configuration file at PATH, which holds one
+// key=value setting per line, with # comments and blank lines.  A
+// value wholly in single or double quotes is unquoted, as the shell
+// would.  A missing file configures nothing.
+func ReadConfig(path string) (config map[string]string, err error) {
+	config = make(map[string]string)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 || strings.ContainsAny(line[:i], " \t") || strings.HasPrefix(line[i+1:], " ") {
+			return nil, fmt.Errorf("%s:%d: Expected key=value, not %q", path, n, line)
+		}
+		config[line[:i]] = unquote(line[i+1:])
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// unquote strips the single or double quotes around VALUE, if any
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
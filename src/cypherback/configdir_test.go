@@ -0,0 +1,59 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cypherback.conf")
+	config, err := ReadConfig(path)
+	if err != nil || len(config) != 0 {
+		t.Error("Read a missing configuration:", config, err)
+	}
+	err = ioutil.WriteFile(path, []byte("# packing\npack_size='8'\n\nexclude=*.o,/tmp/a=b\npadding=\ncompression=\"none\"\nxattr_include='user\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config) != 5 || config["pack_size"] != "8" || config["exclude"] != "*.o,/tmp/a=b" || config["padding"] != "" || config["compression"] != "none" || config["xattr_include"] != "'user" {
+		t.Error("Read", config)
+	}
+	for _, line := range []string{"pack_size", "=8", "pack_size = 8", " pack_size=8"} {
+		err = ioutil.WriteFile(path, []byte(line+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ReadConfig(path)
+		if err == nil {
+			t.Errorf("Read %q", line)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+
+Excluding files
+
+Files are excluded by gitignore-style patterns, given as options or
+read from a .cypherbackignore file in any directory backed up.  A
+pattern in such a file applies to that directory and everything
+below it; patterns given as options are treated as if they were in a
+.cypherbackignore in the root directory.  A pattern with no slash
+matches a name at any depth; any other pattern is relative to its
+file's directory.  A trailing slash matches only directories, a
+leading ! re-includes what an earlier pattern excluded, * and ?
+never match a slash, and ** matches any number of directories.
+Patterns in deeper files take precedence, and so do later patterns
+in the same file.
+
+A directory tagged as a cache by a CACHEDIR.TAG file (see
+<URL:http://www.brynosaurus.com/cachedir/>) may also be excluded, as
+may anything on another filesystem from the path being backed up and
+regular files over a certain size.  Sockets, which cannot be backed
+up, always are.
+
+*/
+
+// ignoreFileName is the name of the per-directory exclude file
+const ignoreFileName = ".cypherbackignore"
+
+// cacheTagName is the name of the file which tags a cache directory,
+// and cacheTagSignature the start of its contents
+const (
+	cacheTagName      = "CACHEDIR.TAG"
+	cacheTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// ExcludeOptions select the files which a backup skips
+type ExcludeOptions struct {
+	// Patterns are gitignore-style patterns, treated as if in a
+	// .cypherbackignore in the root directory
+	Patterns []string
+	// OneFileSystem keeps a backup from descending into
+	// directories on other filesystems than the path backed up
+	OneFileSystem bool
+	// ExcludeCaches backs up only the tag of each directory tagged
+	// with a CACHEDIR.TAG
+	ExcludeCaches bool
+	// MaxFileSize, if not zero, is the size in bytes of the largest
+	// regular file backed up
+	MaxFileSize int64
+	// Report, if not nil, is called with each path excluded and the
+	// reason why
+	Report func(path, reason string)
+}
+
+// An excludePattern is a parsed gitignore-style pattern
+type excludePattern struct {
+	text     string
+	negate   bool
+	dirOnly  bool
+	segments []string
+}
+
+// parseExcludePattern parses LINE of an exclude file, returning false
+// if it is blank or a comment
+func parseExcludePattern(line string) (p excludePattern, ok bool, err error) {
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return p, false, nil
+	}
+	p.text = line
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return p, false, fmt.Errorf("Invalid exclude pattern %q", p.text)
+	}
+	// a pattern with a slash before its end is relative to its
+	// file's directory; any other matches at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if !anchored {
+		p.segments = append(p.segments, "**")
+	}
+	for _, segment := range strings.Split(line, "/") {
+		_, err = path.Match(segment, "")
+		if err != nil {
+			return p, false, fmt.Errorf("Invalid exclude pattern %q", p.text)
+		}
+		p.segments = append(p.segments, segment)
+	}
+	return p, true, nil
+}
+
+// matchSegments reports whether the path segments NAME match the
+// pattern segments PATTERN
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				// a trailing ** matches everything inside,
+				// but not the directory itself
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		matched, _ := path.Match(pattern[0], name[0])
+		if !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// match reports whether the path REL, relative to the directory of
+// the pattern's file, matches the pattern
+func (p excludePattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(p.segments, strings.Split(filepath.ToSlash(rel), "/"))
+}
+
+// An ignoreFile holds the patterns which apply below directory DIR,
+// read from SOURCE
+type ignoreFile struct {
+	dir      string
+	source   string
+	patterns []excludePattern
+}
+
+// parseIgnoreFile parses LINES, the patterns of SOURCE, which apply
+// below the absolute directory DIR
+func parseIgnoreFile(dir, source string, lines []string) (file ignoreFile, err error) {
+	file = ignoreFile{dir: dir, source: source}
+	for _, line := range lines {
+		pattern, ok, err := parseExcludePattern(line)
+		if err != nil {
+			return file, fmt.Errorf("%s: %v", source, err)
+		}
+		if ok {
+			file.patterns = append(file.patterns, pattern)
+		}
+	}
+	return file, nil
+}
+
+// ReadExcludeFile returns the lines of PATH, a file of exclude
+// patterns in the format of a .cypherbackignore
+func ReadExcludeFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(data), "\n"), nil
+}
+
+// ParseSize parses SIZE, a number of bytes optionally followed by K,
+// M, G or T for KiB, MiB, GiB or TiB
+func ParseSize(size string) (int64, error) {
+	multiplier := int64(1)
+	digits := size
+	if len(size) > 0 {
+		switch strings.ToUpper(size[len(size)-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			digits = size[:len(size)-1]
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("Invalid size %q", size)
+	}
+	return n * multiplier, nil
+}
+
+// SetExcludeOptions selects the files which ProcessPath skips.  By
+// default only sockets are.
+func (b *BackupSet) SetExcludeOptions(options *ExcludeOptions) error {
+	if options == nil {
+		b.excludeOptions = ExcludeOptions{}
+		b.excludeRules = nil
+		return nil
+	}
+	rules, err := parseIgnoreFile(string(filepath.Separator), "exclude options", options.Patterns)
+	if err != nil {
+		return err
+	}
+	b.excludeOptions = *options
+	b.excludeRules = []ignoreFile{rules}
+	return nil
+}
+
+// reportExcluded reports that PATH was excluded, and why
+func (b *BackupSet) reportExcluded(path, reason string) {
+	if b.excludeOptions.Report != nil {
+		b.excludeOptions.Report(path, reason)
+	}
+}
+
+// excluded returns why the file at PATH, whose absolute path is ABS,
+// is excluded by RULES and B's options, or the empty string if it is
+// not
+func (b *BackupSet) excluded(abs string, info os.FileInfo, rules []ignoreFile) string {
+	if info.Mode()&os.ModeSocket != 0 {
+		return "sockets cannot be backed up"
+	}
+	for i := len(rules) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(rules[i].dir, abs)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		patterns := rules[i].patterns
+		for j := len(patterns) - 1; j >= 0; j-- {
+			if !patterns[j].match(rel, info.IsDir()) {
+				continue
+			}
+			if patterns[j].negate {
+				return ""
+			}
+			return fmt.Sprintf("matches %q in %s", patterns[j].text, rules[i].source)
+		}
+	}
+	maxSize := b.excludeOptions.MaxFileSize
+	if maxSize > 0 && info.Mode().IsRegular() && info.Size() > maxSize {
+		return fmt.Sprintf("larger than %d bytes", maxSize)
+	}
+	return ""
+}
+
+// isCacheDir reports whether the directory PATH, containing NAMES, is
+// tagged as a cache
+func isCacheDir(path string, names []string) bool {
+	i := sort.SearchStrings(names, cacheTagName)
+	if i == len(names) || names[i] != cacheTagName {
+		return false
+	}
+	file, err := os.Open(filepath.Join(path, cacheTagName))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	signature := make([]byte, len(cacheTagSignature))
+	_, err = io.ReadFull(file, signature)
+	return err == nil && string(signature) == cacheTagSignature
+}
+
+// fileDevice returns the device holding the file INFO describes
+func fileDevice(info os.FileInfo) (device uint64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Dev), true
+}
+
+// A walker walks the tree below one path backed up
+type walker struct {
+	set    *BackupSet
+	device uint64
+}
+
+// walkPath records ROOT and, unless they are excluded, everything
+// below it, in lexical order.  Files which cannot be backed up are
+// recorded as such; see file_errors.go.
+func (b *BackupSet) walkPath(root string) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return b.recordFileError(&FileError{root, err})
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	if reason := b.excluded(abs, info, b.excludeRules); reason != "" {
+		b.reportExcluded(root, reason)
+		return nil
+	}
+	w := &walker{set: b}
+	w.device, _ = fileDevice(info)
+	return w.walk(root, abs, info, b.excludeRules)
+}
+
+// walk records the file at PATH, whose absolute path is ABS, and if it
+// is a directory everything in it which RULES and the set's options
+// do not exclude
+func (w *walker) walk(path, abs string, info os.FileInfo, rules []ignoreFile) error {
+	b := w.set
+	record, err := b.fileRecordFromFileInfo(path, info)
+	if err != nil {
+		return b.recordFileError(err)
+	}
+	b.records = append(b.records, record)
+	if info.Mode().IsRegular() {
+		return b.recordFileError(checkUnchanged(path, info))
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	if b.excludeOptions.OneFileSystem {
+		device, ok := fileDevice(info)
+		if ok && device != w.device {
+			b.reportExcluded(path, "contents are on another filesystem")
+			return nil
+		}
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return b.recordFileError(&FileError{path, err})
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return b.recordFileError(&FileError{path, err})
+	}
+	sort.Strings(names)
+	if b.excludeOptions.ExcludeCaches && isCacheDir(path, names) {
+		b.reportExcluded(path, "contents are a cache tagged by "+cacheTagName)
+		names = []string{cacheTagName}
+	}
+	i := sort.SearchStrings(names, ignoreFileName)
+	if i < len(names) && names[i] == ignoreFileName {
+		source := filepath.Join(path, ignoreFileName)
+		lines, err := ReadExcludeFile(source)
+		var file ignoreFile
+		if err == nil {
+			file, err = parseIgnoreFile(abs, source, lines)
+		}
+		if err != nil {
+			// the directory is still backed up, without the
+			// file's exclusions
+			b.recordFileError(&FileError{source, err})
+		} else {
+			// copied, so that sibling directories do not
+			// share it
+			rules = append(rules[:len(rules):len(rules)], file)
+		}
+	}
+	for _, name := range names {
+		childPath := filepath.Join(path, name)
+		childAbs := filepath.Join(abs, name)
+		childInfo, err := os.Lstat(childPath)
+		if err != nil {
+			// most likely it has vanished since the
+			// directory was read
+			err = b.recordFileError(&FileError{childPath, err})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if reason := b.excluded(childAbs, childInfo, rules); reason != "" {
+			b.reportExcluded(childPath, reason)
+			continue
+		}
+		err = w.walk(childPath, childAbs, childInfo, rules)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestExcludePatterns(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		path    string
+		isDir   bool
+		match   bool
+	}{
+		{"*.o", "main.o", false, true},
+		{"*.o", "src/lib/main.o", false, true},
+		{"*.o", "main.c", false, false},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "src/build", true, true},
+		{"/build", "build", false, true},
+		{"/build", "src/build", false, false},
+		{"doc/*.txt", "doc/notes.txt", false, true},
+		{"doc/*.txt", "doc/old/notes.txt", false, false},
+		{"doc/*.txt", "src/doc/notes.txt", false, false},
+		{"**/logs", "a/b/logs", true, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**", "a/x/y", false, true},
+		{"a/**", "a", true, false},
+		{"\\#notes", "#notes", false, true},
+		{"trailing  ", "trailing", false, true},
+		{"!keep.o", "keep.o", false, true},
+	} {
+		pattern, ok, err := parseExcludePattern(test.pattern)
+		if err != nil || !ok {
+			t.Errorf("Cannot parse %q: %v", test.pattern, err)
+			continue
+		}
+		if pattern.match(test.path, test.isDir) != test.match {
+			t.Errorf("%q matches %s: %v", test.pattern, test.path, !test.match)
+		}
+	}
+	for _, line := range []string{"", "# comment", "   "} {
+		_, ok, err := parseExcludePattern(line)
+		if ok || err != nil {
+			t.Errorf("Parsed %q as a pattern: %v", line, err)
+		}
+	}
+	_, _, err := parseExcludePattern("[")
+	if err == nil {
+		t.Error("Parsed an invalid pattern")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for size, n := range map[string]int64{"0": 0, "512": 512, "4k": 4096, "10M": 10 << 20, "2G": 2 << 30, "1T": 1 << 40} {
+		parsed, err := ParseSize(size)
+		if err != nil || parsed != n {
+			t.Errorf("Parsed %s as %d: %v", size, parsed, err)
+		}
+	}
+	for _, size := range []string{"", "M", "-1", "1.5G", "9999999999T"} {
+		_, err := ParseSize(size)
+		if err == nil {
+			t.Error("Parsed invalid size", size)
+		}
+	}
+}
+
+func TestExclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"keep":                   "kept",
+		"main.o":                 "excluded by option",
+		"big":                    strings.Repeat("x", 100),
+		"src/.cypherbackignore":  "*.tmp\n!important.o\n/generated/\n",
+		"src/important.o":        "re-included",
+		"src/scratch.tmp":        "excluded by src's file",
+		"src/generated/code":     "excluded with its directory",
+		"src/lib/generated/code": "not excluded, as the pattern is anchored",
+		"other/scratch.tmp":      "not excluded, as src's file does not apply",
+		"cache/CACHEDIR.TAG":     cacheTagSignature + "\n",
+		"cache/data":             "excluded as a cache",
+		"notcache/CACHEDIR.TAG":  "no signature",
+		"notcache/data":          "kept",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := newBackupSet("exclude", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	excluded := make(map[string]string)
+	err = set.SetExcludeOptions(&ExcludeOptions{
+		Patterns:      []string{"*.o"},
+		ExcludeCaches: true,
+		MaxFileSize:   50,
+		Report: func(path, reason string) {
+			excluded[path] = reason
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.StartBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ProcessPath(set, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, record := range set.records {
+		var name string
+		switch record := record.(type) {
+		case *directoryInfo:
+			name = record.name
+		case *regularFileInfo:
+			name = record.name
+		default:
+			continue
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, filepath.ToSlash(rel))
+	}
+	expected := []string{".", "cache", "cache/CACHEDIR.TAG", "keep",
+		"notcache", "notcache/CACHEDIR.TAG", "notcache/data",
+		"other", "other/scratch.tmp",
+		"src", "src/.cypherbackignore", "src/important.o",
+		"src/lib", "src/lib/generated", "src/lib/generated/code"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Error("Backed up", names)
+	}
+	var reported []string
+	for path := range excluded {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reported = append(reported, filepath.ToSlash(rel))
+	}
+	sort.Strings(reported)
+	expected = []string{"big", "cache", "main.o", "socket", "src/generated", "src/scratch.tmp"}
+	if !reflect.DeepEqual(reported, expected) {
+		t.Error("Reported exclusion of", reported)
+	}
+	if reason := excluded[filepath.Join(dir, "src/scratch.tmp")]; !strings.Contains(reason, `"*.tmp"`) {
+		t.Error("Reported", reason, "as the reason for excluding src/scratch.tmp")
+	}
+}
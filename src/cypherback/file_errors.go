@@ -0,0 +1,131 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+
+Per-file errors
+
+A file which cannot be backed up, because it cannot be read, vanished
+while the backup ran or is of a kind which cannot be backed up, does
+not stop the rest of the backup.  Instead its path and the error are
+recorded in the run as an error record (type 10), and the error is
+kept for the caller to report once the run has been written.  A
+regular file which changes while it is read is backed up as read,
+and also gets an error record.
+
+*/
+
+// A FileError is an error in backing up one file, after which the
+// rest of the backup carries on
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("Cannot back up %s: %v", e.Path, e.Err)
+}
+
+// FileErrors returns the errors in backing up files in the current
+// run
+func (b *BackupSet) FileErrors() []*FileError {
+	return b.fileErrors
+}
+
+// recordFileError records ERR, if it is a *FileError, in the current
+// run and returns nil; any other error is returned
+func (b *BackupSet) recordFileError(err error) error {
+	fileErr, ok := err.(*FileError)
+	if !ok {
+		return err
+	}
+	b.fileErrors = append(b.fileErrors, fileErr)
+	b.records = append(b.records, &errorRecord{name: fileErr.Path, message: fileErr.Err.Error()})
+	return nil
+}
+
+// checkUnchanged returns a *FileError if the file at PATH no longer
+// has the size and modification time of INFO
+func checkUnchanged(path string, info os.FileInfo) error {
+	now, err := os.Lstat(path)
+	if err != nil {
+		return &FileError{path, err}
+	}
+	if now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime()) {
+		return &FileError{path, fmt.Errorf("File changed while being backed up")}
+	}
+	return nil
+}
+
+// An errorRecord records a file which could not be backed up
+type errorRecord struct {
+	name    string
+	message string
+}
+
+func readErrorRecord(reader io.Reader) (fileRecord, error) {
+	var nameLength, messageLength uint32
+	err := binary.Read(reader, binary.BigEndian, &nameLength)
+	if err != nil {
+		return nil, err
+	}
+	name, err := readLenString(reader, nameLength)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &messageLength)
+	if err != nil {
+		return nil, err
+	}
+	message, err := readLenString(reader, messageLength)
+	if err != nil {
+		return nil, err
+	}
+	return errorRecord{name: name, message: message}, nil
+}
+
+func (r errorRecord) Record() (uint8, []byte, error) {
+	writer := &bytes.Buffer{}
+	err := writeLenString(writer, "name", r.name)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = writeLenString(writer, "error message", r.message)
+	if err != nil {
+		return 0, nil, err
+	}
+	return 10, writer.Bytes(), nil
+}
+
+func (r errorRecord) Len() uint64 {
+	return 2 + 4 + uint64(len(r.name)) + 4 + uint64(len(r.message))
+}
+
+// Restore does nothing: there is nothing of the file to restore
+func (r errorRecord) Restore(*restorer) error {
+	return nil
+}
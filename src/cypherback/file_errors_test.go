@@ -0,0 +1,166 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	memoryBackend "cypherback/backends/memory"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "readable"), []byte("readable"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+	failing := []string{missing}
+	// root can read anything
+	if os.Geteuid() != 0 {
+		unreadable := filepath.Join(dir, "unreadable")
+		err = ioutil.WriteFile(unreadable, []byte("unreadable"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		failing = append(failing, unreadable)
+	}
+
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := memoryBackend.New()
+	set, err := EnsureBackupSet(backend, secrets, "errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.StartBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{dir, missing} {
+		err = ProcessPath(set, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = set.EndBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.FileErrors()) != len(failing) {
+		t.Fatal("Backing up reported", set.FileErrors())
+	}
+	for _, fileErr := range set.FileErrors() {
+		found := false
+		for _, path := range failing {
+			found = found || fileErr.Path == path
+		}
+		if !found {
+			t.Error("Unexpected error", fileErr)
+		}
+	}
+
+	set, err = ReadBackupSet(backend, secrets, "errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := 0
+	backedUp := false
+	for _, record := range set.records {
+		switch record := record.(type) {
+		case errorRecord:
+			recorded++
+			if record.message == "" {
+				t.Error("No error recorded for", record.name)
+			}
+		case regularFileInfo:
+			backedUp = backedUp || record.name == filepath.Join(dir, "readable")
+		}
+	}
+	if recorded != len(failing) {
+		t.Error("Recorded", recorded, "errors")
+	}
+	if !backedUp {
+		t.Error("The readable file was not backed up")
+	}
+	listing := &bytes.Buffer{}
+	err = ListBackupSet(backend, secrets, "errors", 0, listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(listing.String(), missing+": not backed up") {
+		t.Error("Listed", listing.String())
+	}
+}
+
+func TestCheckUnchanged(t *testing.T) {
+	file, err := ioutil.TempFile("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkUnchanged(file.Name(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("more"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkUnchanged(file.Name(), info)
+	if _, ok := err.(*FileError); !ok {
+		t.Error("A grown file was reported as", err)
+	}
+	err = os.Chtimes(file.Name(), time.Now(), time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Lstat(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(file.Name(), time.Now(), time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkUnchanged(file.Name(), info)
+	if _, ok := err.(*FileError); !ok {
+		t.Error("A modified file was reported as", err)
+	}
+}
@@ -20,7 +20,9 @@ package cypherback
 import (
 	//"fmt"
 	memoryBackend "cypherback/backends/memory"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -50,3 +52,105 @@ func TestFileInfo(t *testing.T) {
 	}
 	ProcessPath(backupSet, ".")
 }
+
+func TestHardLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	for _, subdir := range []string{"a", "b/c"} {
+		err = os.MkdirAll(path(subdir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(path("a/file"), []byte("linked contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path("b/unlinked"), []byte("linked contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{"b/c/link", "link"} {
+		err = os.Link(path("a/file"), path(link))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := memoryBackend.New()
+	set, err := EnsureBackupSet(backend, secrets, "links")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for run := 0; run < 2; run++ {
+		err = set.StartBackup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ProcessPath(set, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = set.EndBackup()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = set.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err = ReadBackupSetRuns(backend, secrets, "links", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := make(map[string]string)
+	for _, record := range set.records {
+		switch record := record.(type) {
+		case hardLinkInfo:
+			links[record.name] = record.linkPath
+		case regularFileInfo:
+			if record.name == path("b/c/link") || record.name == path("link") {
+				t.Error("Backed up link", record.name, "as a file")
+			}
+		}
+	}
+	// each run links to a file recorded in that run
+	if len(links) != 2 || links[path("b/c/link")] != path("a/file") || links[path("link")] != path("a/file") {
+		t.Error("Recorded links", links)
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RestoreBackupSet(backend, secrets, "links", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Lstat(path("a/file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b/c/link", "link"} {
+		link, err := os.Lstat(path(name))
+		if err != nil || !os.SameFile(file, link) {
+			t.Error(name, "was not restored as a link:", err)
+		}
+	}
+	unlinked, err := os.Lstat(path("b/unlinked"))
+	if err != nil || os.SameFile(file, unlinked) {
+		t.Error("An identical file was restored as a link:", err)
+	}
+}
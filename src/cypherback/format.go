@@ -19,6 +19,8 @@ package cypherback
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/lzw"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
@@ -28,8 +30,9 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
-	"path/filepath"
 	//"bufio"
 )
 
@@ -44,12 +47,15 @@ type metadata struct {
 Chunk format
 
 Byte Length
-  0    1    version (zero for this format)
-  1    1    compressed?
-  2   16    initialisation vector
- 18    4    length
- 22    -    AES-256-CTR(chunk encryption key, data)
-  -   48    HMAC-SHA-384(chunk authentication key, all preceding bytes)
+  0    1    version (0 for AES-256-CTR; 1 for AES-256-GCM; 2 for
+            padded AES-256-GCM)
+  1   48    nonce
+ 49    -    encrypted: compressed? (1 byte), then data; in version 2
+            preceded by their 4-byte length and followed by padding
+  -   16    GCM tag (versions 1 and 2)
+  -   48    HMAC-SHA-384(chunk authentication key, all preceding bytes,
+            with the key and IV after the nonce, and the length of
+            the preceding bytes)
 
 Each chunk is stored to the backing store under the name
 HMAC-SHA-384(chunk storage key, plaintext).
@@ -65,153 +71,291 @@ emit all path/info tuples
 // found, appending to a list which is return; in later versions, do
 // smarter things like having workers &c.
 
+// ProcessPath records PATH and everything below it which the backup
+// set's exclude options do not exclude; see exclude.go
 func ProcessPath(backupSet *BackupSet, path string) (err error) {
-	walkfunc := func(path string, info os.FileInfo, err error) error {
-		record, err := backupSet.fileRecordFromFileInfo(path, info)
+	return backupSet.walkPath(path)
+}
+
+// Chunk and backup set format versions.  The version selects the
+// cipher mode and whether the plaintext is padded; every version is
+// read, but only the current one is written.
+const (
+	ctrVersion           = 0
+	gcmVersion           = 1
+	paddedVersion        = 2 // GCM, with padding
+	currentFormatVersion = paddedVersion
+)
+
+// validFormatVersion reports whether VERSION is a known chunk or
+// backup set format version
+func validFormatVersion(version uint8) bool {
+	return version <= paddedVersion
+}
+
+// A padding scheme hides the exact size of chunks and backup sets,
+// at the cost of storage
+type padding uint8
+
+const (
+	padNone padding = iota
+	// up to 255 random bytes
+	padRandom
+	// up to the next power of two, of at least 512 bytes
+	padPowerOfTwo
+)
+
+// parsePadding returns the padding scheme called NAME: one of "none",
+// "random" and "pow2"
+func parsePadding(name string) (padding, error) {
+	switch name {
+	case "none":
+		return padNone, nil
+	case "random":
+		return padRandom, nil
+	case "pow2":
+		return padPowerOfTwo, nil
+	}
+	return 0, fmt.Errorf("Unknown padding %s", name)
+}
+
+// padLength returns the number of bytes with which to pad SIZE bytes
+func (p padding) padLength(size int) (int, error) {
+	switch p {
+	case padNone:
+		return 0, nil
+	case padRandom:
+		length, err := genNonce(1)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		backupSet.records = append(backupSet.records, record)
-		return nil
+		return int(length[0]), nil
+	case padPowerOfTwo:
+		bucket := 512
+		for bucket < size {
+			bucket *= 2
+		}
+		return bucket - size, nil
+	}
+	return 0, fmt.Errorf("Unknown padding %d", p)
+}
+
+// padPlaintext prefixes PLAINTEXT with its 4-byte length and pads it
+// with zeroes according to SCHEME
+func padPlaintext(plaintext []byte, scheme padding) ([]byte, error) {
+	if uint64(len(plaintext)) > math.MaxUint32 {
+		return nil, fmt.Errorf("Plaintext of %d bytes is too long to pad", len(plaintext))
+	}
+	padLength, err := scheme.padLength(4 + len(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	padded := make([]byte, 4+len(plaintext)+padLength)
+	binary.BigEndian.PutUint32(padded, uint32(len(plaintext)))
+	copy(padded[4:], plaintext)
+	return padded, nil
+}
+
+// unpadPlaintext strips the length and padding added by padPlaintext
+func unpadPlaintext(padded []byte) ([]byte, error) {
+	if len(padded) < 4 {
+		return nil, fmt.Errorf("Padded plaintext is only %d bytes", len(padded))
+	}
+	length := binary.BigEndian.Uint32(padded)
+	if uint64(length) > uint64(len(padded)-4) {
+		return nil, fmt.Errorf("Padded plaintext claims %d bytes, but has %d", length, len(padded)-4)
 	}
-	return filepath.Walk(path, walkfunc)
+	return padded[4 : 4+length], nil
 }
 
+// chunkKeys derives the 256-bit chunk encryption key and 128-bit IV
+// for NONCE; the caller must wipe them
+func chunkKeys(secrets *Secrets, nonce []byte) keyBuffer {
+	digester := hmac.New(sha512.New384, secrets.chunkMaster)
+	digester.Write([]byte("\000chunk encryption\000"))
+	digester.Write(nonce)
+	digester.Write([]byte{0x01, 0x80})
+	return lockKey(digester.Sum(nil))
+}
+
+// An encWriter encrypts a chunk as it is written.  In GCM mode the
+// whole chunk is needed before anything can be written, so it is
+// buffered and sealed on Close.
 type encWriter struct {
-	plaintext    io.Writer
-	cyphertext   io.Writer
+	writer       io.Writer // the destination, teed into authHMAC
+	stream       io.Writer // CTR mode only
+	aead         cipher.AEAD
+	aeadNonce    keyBuffer
+	aeadData     []byte
+	padding      padding // padded versions only
+	buffer       bytes.Buffer
 	authHMAC     hash.Hash
 	bytesWritten int32
 }
 
-// FIXME: the semantics of an encWriter are goofy
-
 func (ew *encWriter) Write(b []byte) (n int, err error) {
-	n, err = ew.cyphertext.Write(b)
+	if ew.aead != nil {
+		return ew.buffer.Write(b)
+	}
+	n, err = ew.stream.Write(b)
 	ew.bytesWritten += int32(n)
 	return n, err
 }
 
 func (ew *encWriter) Close() error {
-	hashErr := binary.Write(ew.authHMAC, binary.BigEndian, ew.bytesWritten)
-	authSum := ew.authHMAC.Sum(nil)
-	_, writeErr := ew.plaintext.Write(authSum)
-	var plaintextError, cyphertextError error
-	if plaintext, ok := ew.plaintext.(io.ReadCloser); ok {
-		plaintextError = plaintext.Close()
-	}
-	if cyphertext, ok := ew.cyphertext.(io.ReadCloser); ok {
-		cyphertextError = cyphertext.Close()
-	}
-	if hashErr != nil || writeErr != nil || plaintextError != nil || cyphertextError != nil {
-		return fmt.Errorf("Closure error")
+	if ew.aead != nil {
+		plaintext := ew.buffer.Bytes()
+		if ew.aeadData[0] >= paddedVersion {
+			padded, err := padPlaintext(plaintext, ew.padding)
+			zeroBytes(plaintext)
+			if err != nil {
+				return err
+			}
+			plaintext = padded
+		}
+		sealed := ew.aead.Seal(nil, ew.aeadNonce, plaintext, ew.aeadData)
+		zeroBytes(plaintext)
+		ew.aeadNonce.wipe()
+		n, err := ew.writer.Write(sealed)
+		ew.bytesWritten += int32(n)
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+	// no errors are possible from hash.Write, per the docs
+	binary.Write(ew.authHMAC, binary.BigEndian, ew.bytesWritten)
+	_, err := ew.writer.Write(ew.authHMAC.Sum(nil))
+	return err
 }
 
-func newEncWriter(w io.Writer, secrets *Secrets) (*encWriter, error) {
-	nonce, err := genKey(48)
+// newEncWriter returns a writer which encrypts a chunk to W in format
+// VERSION, padded according to PAD if the version supports padding
+func newEncWriter(w io.Writer, secrets *Secrets, version uint8, pad padding) (*encWriter, error) {
+	if !validFormatVersion(version) {
+		return nil, fmt.Errorf("Unsupported chunk version %d", version)
+	}
+	nonce, err := genNonce(48)
 	if err != nil {
 		return nil, err
 	}
-	digester := hmac.New(sha512.New384, secrets.chunkMaster)
-	digester.Write([]byte("\000chunk encryption\000"))
-	digester.Write(nonce)
-	digester.Write([]byte{0x01, 0x80})
-	derivedKey := digester.Sum(nil)
+	derivedKey := chunkKeys(secrets, nonce)
+	defer derivedKey.wipe()
 	key := derivedKey[0:32]
 	iv := derivedKey[32:48]
 	aesCypher, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	cypher := cipher.NewCTR(aesCypher, iv)
 	authHMAC := hmac.New(sha512.New384, secrets.chunkAuthentication)
 	writer := io.MultiWriter(w, authHMAC)
-	_, err = writer.Write([]byte{0}) // version
+	header := append([]byte{version}, nonce...)
+	_, err = writer.Write(header)
 	if err != nil {
 		return nil, err
 	}
-
-	_, err = writer.Write(nonce)
-	if err != nil {
-		return nil, err
-	}
-
 	authHMAC.Write(key)
 	authHMAC.Write(iv)
-	stream := cipher.StreamWriter{S: cypher, W: writer}
-	n, err := stream.Write([]byte{1}) // compression always true
-	if err != nil {
-		return nil, err
-	}
-	if n != 1 {
-		return nil, fmt.Errorf("Out-of-sync keystream")
+	ew := &encWriter{writer: writer, authHMAC: authHMAC, padding: pad, bytesWritten: int32(len(header))}
+	switch version {
+	case ctrVersion:
+		ew.stream = cipher.StreamWriter{S: cipher.NewCTR(aesCypher, iv), W: writer}
+	default:
+		ew.aead, err = cipher.NewGCM(aesCypher)
+		if err != nil {
+			return nil, err
+		}
+		ew.aeadNonce = newKeyBuffer(ew.aead.NonceSize())
+		copy(ew.aeadNonce, iv)
+		ew.aeadData = header
 	}
-
-	return &encWriter{writer, stream, authHMAC, 50}, nil
+	return ew, nil
 }
 
 type encReader struct {
-	source   io.Reader
-	reader   io.Reader
+	source io.Reader
+	reader io.Reader
+	// nil if the chunk was authenticated in full when opened
 	authHMAC hash.Hash
 	length   int
 	numRead  int
 }
 
 func newEncReader(r io.Reader, secrets *Secrets, length int) (reader *encReader, err error) {
-	buf := make([]byte, 48)
-	n, err := r.Read(buf[:1])
-	if n != 1 {
-		return nil, fmt.Errorf("Error decoding chunk")
-	}
+	header := make([]byte, 49)
+	_, err = io.ReadFull(r, header)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Error decoding chunk: %v", err)
 	}
-	version := buf[0]
-	if version != 0 {
+	version := header[0]
+	if !validFormatVersion(version) {
 		return nil, fmt.Errorf("Unsupported chunk version %d", version)
 	}
-	n, err = r.Read(buf)
-	if n != 48 {
-		return nil, fmt.Errorf("Error decoding chunk")
-	}
-	if err != nil {
-		return nil, err
-	}
-	nonce := make([]byte, 48)
-	copy(nonce, buf)
-	digester := hmac.New(sha512.New384, secrets.chunkMaster)
-	digester.Write([]byte("\000chunk encryption\000"))
-	digester.Write(nonce)
-	digester.Write([]byte{0x01, 0x80})
-	derivedKey := digester.Sum(nil)
+	nonce := header[1:]
+	derivedKey := chunkKeys(secrets, nonce)
+	defer derivedKey.wipe()
 	key := derivedKey[0:32]
 	iv := derivedKey[32:48]
 	aesCypher, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	cypher := cipher.NewCTR(aesCypher, iv)
 	authHMAC := hmac.New(sha512.New384, secrets.chunkAuthentication)
-	authHMAC.Write([]byte{0})
-	authHMAC.Write(nonce)
+	authHMAC.Write(header)
 	authHMAC.Write(key)
 	authHMAC.Write(iv)
-	cypherStream := cipher.StreamReader{S: cypher, R: io.TeeReader(r, authHMAC)}
-	n, err = cypherStream.Read(buf[0:1])
-	if n != 1 {
-		return nil, fmt.Errorf("Error decoding chunk")
+	if version >= gcmVersion {
+		return openGCMChunk(r, aesCypher, iv, header, authHMAC, length)
 	}
+	cypher := cipher.NewCTR(aesCypher, iv)
+	cypherStream := cipher.StreamReader{S: cypher, R: io.TeeReader(r, authHMAC)}
+	return &encReader{source: r, reader: cypherStream, authHMAC: authHMAC, length: length - 48, numRead: len(header)}, nil
+}
+
+// openGCMChunk authenticates and decrypts the remainder of a GCM
+// chunk of LENGTH bytes, whose header has already been read from R.
+// GCM cannot release any plaintext until it has seen the whole chunk,
+// so it is all done at once.
+func openGCMChunk(r io.Reader, aesCypher cipher.Block, iv, header []byte, authHMAC hash.Hash, length int) (*encReader, error) {
+	aead, err := cipher.NewGCM(aesCypher)
 	if err != nil {
 		return nil, err
 	}
-	//compressed_p := buf[0] != 0
-	return &encReader{source: r, reader: cypherStream, authHMAC: authHMAC, length: length - 48, numRead: 50}, nil
+	sealedLength := length - len(header) - sha512.Size384
+	if sealedLength < 1+aead.Overhead() {
+		return nil, fmt.Errorf("Error decoding chunk: %d bytes long", length)
+	}
+	sealed := make([]byte, sealedLength)
+	_, err = io.ReadFull(r, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding chunk: %v", err)
+	}
+	authTag := make([]byte, sha512.Size384)
+	_, err = io.ReadFull(r, authTag)
+	if err != nil {
+		return nil, fmt.Errorf("Could not authenticate chunk: %v", err)
+	}
+	authHMAC.Write(sealed)
+	binary.Write(authHMAC, binary.BigEndian, int32(length-sha512.Size384))
+	if !hmac.Equal(authHMAC.Sum(nil), authTag) {
+		return nil, fmt.Errorf("Could not authenticate chunk")
+	}
+	plaintext, err := aead.Open(nil, iv[:aead.NonceSize()], sealed, header)
+	if err != nil {
+		return nil, fmt.Errorf("Could not authenticate chunk")
+	}
+	if header[0] >= paddedVersion {
+		plaintext, err = unpadPlaintext(plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding chunk: %v", err)
+		}
+	}
+	return &encReader{source: r, reader: bytes.NewReader(plaintext)}, nil
 }
 
 func (r *encReader) Read(buf []byte) (n int, err error) {
+	if r.authHMAC == nil {
+		return r.reader.Read(buf)
+	}
 	switch {
 	case r.numRead == r.length:
 		return 0, io.EOF
@@ -229,22 +373,170 @@ func (r *encReader) Read(buf []byte) (n int, err error) {
 }
 
 func (r *encReader) Close() error {
-	binary.Write(r.authHMAC, binary.BigEndian, int32(r.length))
-	authTag := make([]byte, 48)
-	n, err := r.source.Read(authTag)
-	if n != 48 {
-		return fmt.Errorf("Could not authenticate chunk", n)
+	if r.authHMAC != nil {
+		binary.Write(r.authHMAC, binary.BigEndian, int32(r.length))
+		authTag := make([]byte, 48)
+		n, err := r.source.Read(authTag)
+		if n != 48 {
+			return fmt.Errorf("Could not authenticate chunk")
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(r.authHMAC.Sum(nil), authTag) {
+			return fmt.Errorf("Could not authenticate chunk\n%s\n%s", hex.EncodeToString(r.authHMAC.Sum(nil)), hex.EncodeToString(authTag))
+		}
+	}
+	if source, ok := r.source.(io.ReadCloser); ok {
+		return source.Close()
+	}
+	return nil
+}
+
+// Chunk compression methods, as recorded in each chunk
+type compression uint8
+
+const (
+	compressNone    compression = 0
+	compressLZW     compression = 1
+	compressDeflate compression = 2
+	// never recorded: compress with DEFLATE, but store chunks which
+	// do not shrink uncompressed
+	compressAuto compression = 255
+)
+
+// parseCompression returns the compression method called NAME: one
+// of "none", "lzw", "deflate" (or "gzip") and "auto"
+func parseCompression(name string) (compression, error) {
+	switch name {
+	case "none":
+		return compressNone, nil
+	case "lzw":
+		return compressLZW, nil
+	case "deflate", "gzip":
+		return compressDeflate, nil
+	case "auto":
+		return compressAuto, nil
+	}
+	return 0, fmt.Errorf("Unknown compression %s", name)
+}
+
+// compressChunk compresses PLAINTEXT with METHOD, returning the
+// compressed data and the method actually used
+func compressChunk(plaintext []byte, method compression) ([]byte, compression, error) {
+	if method == compressAuto {
+		data, _, err := compressChunk(plaintext, compressDeflate)
+		if err != nil {
+			return nil, 0, err
+		}
+		// already-compressed data, such as JPEGs and archives,
+		// only grow
+		if len(data) >= len(plaintext) {
+			return plaintext, compressNone, nil
+		}
+		return data, compressDeflate, nil
+	}
+	buffer := &bytes.Buffer{}
+	var compressor io.WriteCloser
+	switch method {
+	case compressNone:
+		return plaintext, compressNone, nil
+	case compressLZW:
+		compressor = lzw.NewWriter(buffer, lzw.LSB, 8)
+	case compressDeflate:
+		var err error
+		compressor, err = flate.NewWriter(buffer, flate.DefaultCompression)
+		if err != nil {
+			return nil, 0, err
+		}
+	default:
+		return nil, 0, fmt.Errorf("Unknown compression %d", method)
+	}
+	_, err := compressor.Write(plaintext)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = compressor.Close()
+	if err != nil {
+		return nil, 0, err
 	}
+	return buffer.Bytes(), method, nil
+}
+
+// writeChunk compresses PLAINTEXT with METHOD and encrypts it, padded
+// according to PAD, writing the chunk to W
+func writeChunk(w io.Writer, secrets *Secrets, plaintext []byte, method compression, pad padding) error {
+	data, method, err := compressChunk(plaintext, method)
 	if err != nil {
 		return err
 	}
-	if !bytes.Equal(r.authHMAC.Sum(nil), authTag) {
-		return fmt.Errorf("Could not authenticate chunk\n%s\n%s", hex.EncodeToString(r.authHMAC.Sum(nil)), hex.EncodeToString(authTag))
+	encryptor, err := newEncWriter(w, secrets, currentFormatVersion, pad)
+	if err != nil {
+		return err
 	}
-	if source, ok := r.source.(io.ReadCloser); ok {
-		return source.Close()
+	_, err = encryptor.Write([]byte{uint8(method)})
+	if err != nil {
+		return err
 	}
-	return nil
+	_, err = encryptor.Write(data)
+	if err != nil {
+		return err
+	}
+	return encryptor.Close()
+}
+
+func encryptChunk(secrets *Secrets, plaintext []byte, method compression, pad padding) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	err := writeChunk(buffer, secrets, plaintext, method, pad)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// decryptChunk authenticates, decrypts and decompresses CHUNK
+func decryptChunk(secrets *Secrets, chunk []byte) (data []byte, err error) {
+	encReader, err := newEncReader(bytes.NewReader(chunk), secrets, len(chunk))
+	if err != nil {
+		return nil, err
+	}
+	method := make([]byte, 1)
+	_, err = io.ReadFull(encReader, method)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding chunk: %v", err)
+	}
+	var decompressor io.ReadCloser
+	switch compression(method[0]) {
+	case compressNone:
+		decompressor = ioutil.NopCloser(encReader)
+	case compressLZW:
+		decompressor = lzw.NewReader(encReader, lzw.LSB, 8)
+	case compressDeflate:
+		decompressor = flate.NewReader(encReader)
+	default:
+		return nil, fmt.Errorf("Unknown chunk compression %d", method[0])
+	}
+	data, err = ioutil.ReadAll(decompressor)
+	if err != nil {
+		return nil, err
+	}
+	err = decompressor.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = encReader.Close()
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// chunkStorageId returns the name under which the chunk with
+// PLAINTEXT is stored
+func chunkStorageId(secrets *Secrets, plaintext []byte) string {
+	digester := hmac.New(sha512.New384, secrets.chunkStorage)
+	digester.Write(plaintext)
+	return hex.EncodeToString(digester.Sum(nil))
 }
 
 // func (s *Secrets) decodeChunk(cyphertext []byte) (plaintext []byte, err error) {
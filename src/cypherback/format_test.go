@@ -0,0 +1,151 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChunkVersions(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("chunk data "), 1000)
+	for _, version := range []uint8{ctrVersion, gcmVersion, paddedVersion} {
+		buffer := &bytes.Buffer{}
+		encryptor, err := newEncWriter(buffer, secrets, version, padPowerOfTwo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = encryptor.Write(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = encryptor.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk := buffer.Bytes()
+		if chunk[0] != version {
+			t.Error("Wrote version", chunk[0], "not", version)
+		}
+		decryptor, err := newEncReader(bytes.NewReader(chunk), secrets, len(chunk))
+		if err != nil {
+			t.Fatal(version, err)
+		}
+		decrypted := &bytes.Buffer{}
+		_, err = decrypted.ReadFrom(decryptor)
+		if err != nil {
+			t.Fatal(version, err)
+		}
+		err = decryptor.Close()
+		if err != nil {
+			t.Error(version, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Error("Version", version, "chunk did not decrypt to its plaintext")
+		}
+
+		chunk[60] ^= 1
+		decryptor, err = newEncReader(bytes.NewReader(chunk), secrets, len(chunk))
+		if err == nil {
+			decrypted.ReadFrom(decryptor)
+			err = decryptor.Close()
+		}
+		if err == nil {
+			t.Error("Corrupted version", version, "chunk was accepted")
+		}
+	}
+}
+
+func TestEncryptDecryptChunk(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressible := bytes.Repeat([]byte("some file contents "), 100)
+	random, err := genNonce(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range [][]byte{compressible, random} {
+		for _, method := range []compression{compressNone, compressLZW, compressDeflate, compressAuto} {
+			chunk, err := encryptChunk(secrets, plaintext, method, padRandom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := decryptChunk(secrets, chunk)
+			if err != nil {
+				t.Fatal(method, err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Error("Chunk compressed with", method, "decrypted to", decrypted)
+			}
+		}
+	}
+	// version, nonce, length, compression, data, GCM tag, HMAC
+	chunk, err := encryptChunk(secrets, random, compressAuto, padNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunk) != 1+48+4+1+len(random)+16+48 {
+		t.Error("Incompressible chunk was stored in", len(chunk), "bytes")
+	}
+}
+
+func TestPadding(t *testing.T) {
+	for _, size := range []int{0, 1, 100, 511, 512, 513, 5000} {
+		plaintext := bytes.Repeat([]byte{'x'}, size)
+		for _, scheme := range []padding{padNone, padRandom, padPowerOfTwo} {
+			padded, err := padPlaintext(plaintext, scheme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			extra := len(padded) - 4 - size
+			switch scheme {
+			case padNone:
+				if extra != 0 {
+					t.Error("Unpadded", size, "bytes have", extra, "bytes of padding")
+				}
+			case padRandom:
+				if extra < 0 || extra > 255 {
+					t.Error("Randomly padded", size, "bytes have", extra, "bytes of padding")
+				}
+			case padPowerOfTwo:
+				if len(padded) < 512 || len(padded)&(len(padded)-1) != 0 {
+					t.Error(size, "bytes padded to", len(padded), "not a power of two")
+				}
+			}
+			unpadded, err := unpadPlaintext(padded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(unpadded, plaintext) {
+				t.Error("Unpadded", size, "bytes to", len(unpadded))
+			}
+		}
+	}
+	_, err := unpadPlaintext([]byte{0, 0, 1, 0, 'x'})
+	if err == nil {
+		t.Error("Unpadded plaintext with a bad length")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"fmt"
+	"io"
+)
+
+// CheckBackupSets verifies every backup set stored under SECRETS in
+// BACKEND, and every chunk to which they refer, reporting progress to
+// PROGRESS.
+func CheckBackupSets(backend Backend, secrets *Secrets, progress io.Writer) error {
+	setIds, err := listBackupSets(backend, secrets.HexId())
+	if err != nil {
+		return err
+	}
+	verified := make(map[string]bool)
+	failed := 0
+	for i, setId := range setIds {
+		fmt.Fprintf(progress, "Checking backup set %d of %d\n", i+1, len(setIds))
+		err = verifyBackupSet(backend, secrets, setId, verified)
+		if err != nil {
+			fmt.Fprintf(progress, "Backup set %s: %v\n", setId, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d backup sets failed verification", failed, len(setIds))
+	}
+	return nil
+}
+
+// CollectGarbage deletes every chunk and run stored under SECRETS in
+// BACKEND which no backup set refers to.  If BACKEND is a PackBackend, packs
+// left without an index are deleted, and packs which are less than
+// half full are repacked; otherwise packs and their indices are left
+// alone, since the chunks in them cannot be seen.  No backup may be running while it does so,
+// since a backup's chunks are written before its backup set.
+func CollectGarbage(backend Backend, secrets *Secrets, progress io.Writer) error {
+	secretsId := secrets.HexId()
+	setIds, err := listBackupSets(backend, secretsId)
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]bool)
+	referencedRuns := make(map[string]bool)
+	for _, setId := range setIds {
+		set, err := loadBackupSet(backend, secrets, setId)
+		if err != nil {
+			// better to stop than to delete chunks which an
+			// unreadable set may need
+			return fmt.Errorf("Backup set %s: %v", setId, err)
+		}
+		for _, run := range set.runs {
+			referencedRuns[runObjectId(setId, run.id)] = true
+		}
+		for _, record := range set.records {
+			if record, ok := record.(regularFileInfo); ok {
+				for _, chunkId := range record.chunks {
+					referenced[chunkId] = true
+				}
+			}
+		}
+	}
+	// runs left by an interrupted write or prune
+	ids, err := backend.ListBackupSets(secretsId)
+	if err != nil {
+		return err
+	}
+	orphanRuns := 0
+	for _, id := range ids {
+		if !isRunObject(id) || referencedRuns[id] {
+			continue
+		}
+		err = backend.DeleteBackupSet(secretsId, id)
+		if err != nil {
+			return err
+		}
+		orphanRuns++
+	}
+	if orphanRuns > 0 {
+		fmt.Fprintf(progress, "Deleted %d unreferenced runs\n", orphanRuns)
+	}
+	chunkIds, err := backend.ListChunks(secretsId)
+	if err != nil {
+		return err
+	}
+	deleted := 0
+	for _, chunkId := range chunkIds {
+		// a backend which is not a PackBackend lists packs as
+		// chunks, although no set refers to them by name
+		if referenced[chunkId] || isPackObject(chunkId) {
+			continue
+		}
+		err = backend.DeleteChunk(secretsId, chunkId)
+		if err != nil {
+			return err
+		}
+		deleted++
+	}
+	fmt.Fprintf(progress, "Deleted %d of %d chunks\n", deleted, len(chunkIds))
+	packs, ok := backend.(*PackBackend)
+	if !ok {
+		return nil
+	}
+	err = packs.Flush()
+	if err != nil {
+		return err
+	}
+	orphans, err := packs.removeOrphans(secretsId)
+	if err != nil {
+		return err
+	}
+	repacked, err := packs.Repack(secretsId, 0.5)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(progress, "Deleted %d orphaned packs; repacked %d packs\n", orphans, repacked)
+	return nil
+}
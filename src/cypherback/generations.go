@@ -0,0 +1,171 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+
+Rollback protection
+
+Every secrets file, backup set index and catalog carries a
+generation, which is increased whenever it is written, and which is
+authenticated along with it.  A storage provider could still serve an
+older, validly authenticated version of any of them, such as a
+secrets file from before a passphrase change, so the highest
+generation seen of each is remembered locally, and reading an older
+one fails with a StaleMetadataError.
+
+*/
+
+// version 5 backup sets hold the generation of their index after
+// their tag; see backup_set.go
+const generationVersion = 5
+
+// secretsFileId identifies a secrets file in the generation cache
+const secretsFileId = "secrets"
+
+// A StaleMetadataError reports that a backend served an older version
+// of a backup set or catalog than has been seen before.
+type StaleMetadataError struct {
+	Id     string
+	Seen   uint64
+	Served uint64
+}
+
+func (e *StaleMetadataError) Error() string {
+	return fmt.Sprintf("%s is generation %d, but generation %d has been seen: the backend is serving stale data", e.Id, e.Served, e.Seen)
+}
+
+// A GenerationCache records the highest generation of each backup set
+// and catalog seen.
+type GenerationCache struct {
+	path        string
+	generations map[string]uint64
+}
+
+// the cache used by reads and writes, if any
+var generationCache *GenerationCache
+
+// UseGenerationCache makes reads check against, and reads and writes
+// update, CACHE; a nil CACHE disables rollback detection.
+func UseGenerationCache(cache *GenerationCache) {
+	generationCache = cache
+}
+
+// OpenGenerationCache reads the generation cache stored at PATH, which
+// need not exist yet.
+func OpenGenerationCache(path string) (*GenerationCache, error) {
+	c := &GenerationCache{path: path, generations: make(map[string]uint64)}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Malformed line in %s: %q", path, scanner.Text())
+		}
+		generation, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed line in %s: %q", path, scanner.Text())
+		}
+		c.generations[fields[0]] = generation
+	}
+	return c, scanner.Err()
+}
+
+// save writes the cache out, replacing the old file whole
+func (c *GenerationCache) save() error {
+	file, err := ioutil.TempFile(filepath.Dir(c.path), ".generations")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	for key, generation := range c.generations {
+		fmt.Fprintf(writer, "%s %d\n", key, generation)
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), c.path)
+}
+
+// check returns a StaleMetadataError if GENERATION of the object ID of
+// SECRETSID is older than one already seen, and otherwise records it
+func (c *GenerationCache) check(secretsId, id string, generation uint64) error {
+	if c == nil {
+		return nil
+	}
+	key := secretsId + "/" + id
+	seen := c.generations[key]
+	if generation < seen {
+		return &StaleMetadataError{Id: id, Seen: seen, Served: generation}
+	}
+	if generation == seen {
+		return nil
+	}
+	c.generations[key] = generation
+	return c.save()
+}
+
+// accept records GENERATION of the object ID of SECRETSID as the
+// latest, even if a later one has been seen, as when the user
+// deliberately installs an older copy
+func (c *GenerationCache) accept(secretsId, id string, generation uint64) error {
+	if c == nil {
+		return nil
+	}
+	c.generations[secretsId+"/"+id] = generation
+	return c.save()
+}
+
+// next returns the generation with which to write the object ID of
+// SECRETSID, whose last known generation is CURRENT
+func (c *GenerationCache) next(secretsId, id string, current uint64) uint64 {
+	if c != nil && c.generations[secretsId+"/"+id] > current {
+		current = c.generations[secretsId+"/"+id]
+	}
+	return current + 1
+}
+
+// isStale reports whether ERR is a StaleMetadataError
+func isStale(err error) bool {
+	_, ok := err.(*StaleMetadataError)
+	return ok
+}
@@ -0,0 +1,190 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	memoryBackend "cypherback/backends/memory"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "generations")
+	cache, err := OpenGenerationCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseGenerationCache(cache)
+	defer UseGenerationCache(nil)
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsId := secrets.HexId()
+	id := tagToId(secrets, "foo")
+	backend := memoryBackend.New()
+	var oldSet, oldCatalog []byte
+	for i := 0; i < 3; i++ {
+		set, err := EnsureBackupSet(backend, secrets, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addRun(t, set, "/tmp/run")
+		err = set.Write(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if set.generation != uint64(i+1) {
+			t.Error("Run", i, "left the set at generation", set.generation)
+		}
+		if i == 0 {
+			oldSet, _ = backend.ReadBackupSet(secretsId, id)
+			oldCatalog, _ = backend.ReadBackupSet(secretsId, catalogId)
+		}
+	}
+	// appending bumps the generation as well as rewriting does
+	set, err := ReadBackupSetRuns(backend, secrets, "foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.generation != 3 || set.segments != 3 {
+		t.Error("Read generation", set.generation, "with", set.segments, "segments")
+	}
+	set, err = ReadBackupSetRuns(rewritingBackend{backend}, secrets, "foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRun(t, set, "/tmp/run")
+	err = set.Write(rewritingBackend{backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.generation != 4 || set.segments != 1 {
+		t.Error("Rewrote generation", set.generation, "with", set.segments, "segments")
+	}
+
+	// a backend serving old metadata is caught, even by a new process
+	cache, err = OpenGenerationCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseGenerationCache(cache)
+	backend.WriteBackupSet(secretsId, id, oldSet)
+	_, err = ReadBackupSet(backend, secrets, "foo")
+	if stale, ok := err.(*StaleMetadataError); !ok || stale.Seen != 4 || stale.Served != 1 {
+		t.Error("Reading a rolled back set returned", err)
+	}
+	_, err = EnsureBackupSet(backend, secrets, "foo")
+	if !isStale(err) {
+		t.Error("Ensuring a rolled back set returned", err)
+	}
+	backend.WriteBackupSet(secretsId, catalogId, oldCatalog)
+	_, err = ReadCatalog(backend, secrets)
+	if !isStale(err) {
+		t.Error("Reading a rolled back catalog returned", err)
+	}
+	backend.DeleteBackupSet(secretsId, catalogId)
+	_, err = ReadCatalog(backend, secrets)
+	if !isStale(err) {
+		t.Error("Reading a deleted catalog returned", err)
+	}
+
+	// nor may one set be passed off as another
+	backend.WriteBackupSet(secretsId, tagToId(secrets, "bar"), oldSet)
+	_, err = ReadBackupSet(backend, secrets, "bar")
+	if err == nil {
+		t.Error("Read a backup set stored under another's ID")
+	}
+
+	// without the cache, old metadata is accepted
+	UseGenerationCache(nil)
+	set, err = ReadBackupSet(backend, secrets, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.generation != 1 {
+		t.Error("Read generation", set.generation)
+	}
+}
+
+func TestSecretsGenerations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := OpenGenerationCache(filepath.Join(dir, "generations"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseGenerationCache(cache)
+	defer UseGenerationCache(nil)
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := secrets.HexId()
+	kdf := pbkdf2KDF{iterations: 1024}
+	var encoded [][]byte
+	for generation := uint64(1); generation <= 2; generation++ {
+		secrets.generation = generation
+		encSecrets, err := encodeSecrets(secrets, []byte("passphrase"), kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, encSecrets)
+	}
+	backend := memoryBackend.New()
+	imported, err := importSecrets(backend, encoded[1], nil, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ZeroSecrets(imported)
+	if next := cache.next(id, secretsFileId, 0); next != 3 {
+		t.Error("Next secrets generation is", next)
+	}
+
+	// the file from before, say, a passphrase change is stale
+	old, _, err := decodeSecrets(encoded[0], []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ZeroSecrets(old)
+	if !isStale(cache.check(id, secretsFileId, old.generation)) {
+		t.Error("Accepted a stale secrets file")
+	}
+	// unless it is deliberately imported
+	imported, err = importSecrets(backend, encoded[0], nil, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ZeroSecrets(imported)
+	err = cache.check(id, secretsFileId, 1)
+	if err != nil {
+		t.Error(err)
+	}
+}
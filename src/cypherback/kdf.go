@@ -0,0 +1,240 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"code.google.com/p/go.crypto/pbkdf2"
+	"code.google.com/p/go.crypto/scrypt"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// KDF identifiers, as stored in a version 1 secrets file
+const (
+	kdfPBKDF2 = 0
+	kdfScrypt = 1
+)
+
+// A KDF turns a passphrase and salt into the keys which encrypt and
+// authenticate a secrets file.  Its parameters are stored in the
+// secrets file, so that each file may use a different function or
+// cost.
+type KDF interface {
+	// id returns the KDF identifier stored in the secrets file
+	id() uint8
+	// params returns the encoded parameters stored in the secrets file
+	params() []byte
+	// deriveKeys returns LENGTH bytes of keys, which the caller must
+	// wipe
+	deriveKeys(passphrase, salt []byte, length int) (keyBuffer, error)
+	// scale returns a KDF of the same type whose cost is
+	// approximately FACTOR times this one's
+	scale(factor float64) KDF
+	String() string
+}
+
+// the wall-clock time which unlocking a secrets file should take
+const kdfTarget = time.Second
+
+// the largest scrypt N used when scaling; beyond this (1 GiB of
+// memory with r=8) cost is increased through p instead
+const scryptMaxN = 1 << 20
+
+// KDF parameters are read from the secrets file before anything in it
+// can be authenticated, so these bound what a tampered file can make
+// unlocking cost: about 16 GiB of memory for scrypt, and for each KDF
+// thousands of times the default work.
+const (
+	pbkdf2MaxIterations = 1 << 30
+	scryptLimitN        = 1 << 24
+	scryptMaxMemory     = 1 << 34 // 128*r*N bytes
+	scryptMaxCost       = 1 << 32 // N*r*p
+)
+
+type pbkdf2KDF struct {
+	iterations uint64
+}
+
+func (k pbkdf2KDF) id() uint8 {
+	return kdfPBKDF2
+}
+
+func (k pbkdf2KDF) params() []byte {
+	writer := &bytes.Buffer{}
+	binary.Write(writer, binary.BigEndian, k.iterations)
+	return writer.Bytes()
+}
+
+func (k pbkdf2KDF) deriveKeys(passphrase, salt []byte, length int) (keyBuffer, error) {
+	return lockKey(pbkdf2.Key(passphrase, salt, int(k.iterations), length, sha512.New384)), nil
+}
+
+func (k pbkdf2KDF) scale(factor float64) KDF {
+	iterations := uint64(math.Min(float64(k.iterations)*factor, pbkdf2MaxIterations))
+	if iterations < 1 {
+		iterations = 1
+	}
+	return pbkdf2KDF{iterations: iterations}
+}
+
+func (k pbkdf2KDF) String() string {
+	return fmt.Sprintf("pbkdf2 (SHA-384, %d iterations)", k.iterations)
+}
+
+func readPBKDF2Params(reader io.Reader) (KDF, error) {
+	var k pbkdf2KDF
+	err := binary.Read(reader, binary.BigEndian, &k.iterations)
+	if err != nil {
+		return nil, err
+	}
+	if k.iterations == 0 || k.iterations > pbkdf2MaxIterations {
+		return nil, fmt.Errorf("Invalid PBKDF2 iteration count %d", k.iterations)
+	}
+	return k, nil
+}
+
+type scryptKDF struct {
+	n uint64
+	r uint32
+	p uint32
+}
+
+func (k scryptKDF) id() uint8 {
+	return kdfScrypt
+}
+
+func (k scryptKDF) params() []byte {
+	writer := &bytes.Buffer{}
+	binary.Write(writer, binary.BigEndian, k.n)
+	binary.Write(writer, binary.BigEndian, k.r)
+	binary.Write(writer, binary.BigEndian, k.p)
+	return writer.Bytes()
+}
+
+func (k scryptKDF) deriveKeys(passphrase, salt []byte, length int) (keyBuffer, error) {
+	keys, err := scrypt.Key(passphrase, salt, int(k.n), int(k.r), int(k.p), length)
+	if err != nil {
+		return nil, err
+	}
+	return lockKey(keys), nil
+}
+
+func (k scryptKDF) scale(factor float64) KDF {
+	// time is linear in N*p, so pick the power of two nearest
+	// the desired cost and make up any remainder with p
+	cost := float64(k.n) * float64(k.p) * factor
+	n := uint64(2)
+	for n < scryptMaxN && float64(n)*math.Sqrt2 < cost {
+		n *= 2
+	}
+	p := math.Floor(cost/float64(n) + 0.5)
+	p = math.Min(p, math.Floor(scryptMaxCost/(float64(n)*float64(k.r))))
+	if p < 1 {
+		p = 1
+	}
+	return scryptKDF{n: n, r: k.r, p: uint32(p)}
+}
+
+func (k scryptKDF) String() string {
+	return fmt.Sprintf("scrypt (N=%d, r=%d, p=%d)", k.n, k.r, k.p)
+}
+
+func readScryptParams(reader io.Reader) (KDF, error) {
+	var k scryptKDF
+	err := binary.Read(reader, binary.BigEndian, &k.n)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &k.r)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &k.p)
+	if err != nil {
+		return nil, err
+	}
+	// N must be a power of two greater than one; products are
+	// compared in floating point so that they cannot overflow
+	n, r, p := float64(k.n), float64(k.r), float64(k.p)
+	if k.n < 2 || k.n&(k.n-1) != 0 || k.r == 0 || k.p == 0 ||
+		k.n > scryptLimitN || r*p >= 1<<30 ||
+		128*r*n > scryptMaxMemory || n*r*p > scryptMaxCost {
+		return nil, fmt.Errorf("Invalid scrypt parameters N=%d, r=%d, p=%d", k.n, k.r, k.p)
+	}
+	return k, nil
+}
+
+// readKDF reads the parameters of the KDF identified by ID
+func readKDF(id uint8, reader io.Reader) (KDF, error) {
+	switch id {
+	case kdfPBKDF2:
+		return readPBKDF2Params(reader)
+	case kdfScrypt:
+		return readScryptParams(reader)
+	}
+	return nil, fmt.Errorf("Unknown KDF %d", id)
+}
+
+// CalibrateKDF returns a KDF of the same type as KDF, with its cost
+// tuned to take about one second on this machine.
+func CalibrateKDF(kdf KDF) (KDF, error) {
+	passphrase := []byte("calibration")
+	salt := make([]byte, 32)
+	// start cheaply, so that slow machines aren't stuck waiting on
+	// an expensive trial
+	trial := kdf.scale(1.0 / 16)
+	for {
+		start := time.Now()
+		keys, err := trial.deriveKeys(passphrase, salt, 80)
+		if err != nil {
+			return nil, err
+		}
+		keys.wipe()
+		elapsed := time.Since(start)
+		// too short a trial is dominated by timer noise
+		if elapsed < kdfTarget/16 {
+			trial = trial.scale(8)
+			continue
+		}
+		return trial.scale(float64(kdfTarget) / float64(elapsed)), nil
+	}
+}
+
+// DefaultKDF returns the KDF used for new secrets files.
+func DefaultKDF() KDF {
+	// magic numbers: 128 MiB of memory, about 1 second's worth of
+	// time on my lappop
+	return scryptKDF{n: 1 << 17, r: 8, p: 1}
+}
+
+// NewKDF returns the named KDF with its default parameters.  Known
+// names are "pbkdf2" and "scrypt".
+func NewKDF(name string) (KDF, error) {
+	switch name {
+	case "pbkdf2":
+		return pbkdf2KDF{iterations: 131072}, nil
+	case "scrypt":
+		return DefaultKDF(), nil
+	}
+	return nil, fmt.Errorf("Unknown KDF %s", name)
+}
@@ -0,0 +1,90 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestScaleKDF(t *testing.T) {
+	scaled := scryptKDF{n: 1 << 10, r: 8, p: 1}.scale(5).(scryptKDF)
+	if scaled.n != 1<<12 || scaled.p != 1 {
+		t.Error("Bad scrypt scaling", scaled)
+	}
+	scaled = scryptKDF{n: scryptMaxN, r: 8, p: 1}.scale(3).(scryptKDF)
+	if scaled.n != scryptMaxN || scaled.p != 3 {
+		t.Error("Bad scrypt scaling beyond maximum N", scaled)
+	}
+	iterations := pbkdf2KDF{iterations: 1000}.scale(2.5).(pbkdf2KDF).iterations
+	if iterations != 2500 {
+		t.Error("Bad PBKDF2 scaling", iterations)
+	}
+}
+
+func TestReadKDFLimits(t *testing.T) {
+	for _, kdf := range []KDF{
+		DefaultKDF(),
+		pbkdf2KDF{iterations: 131072},
+		scryptKDF{n: scryptLimitN, r: 8, p: 1},
+		pbkdf2KDF{iterations: pbkdf2MaxIterations},
+	} {
+		_, err := readKDF(kdf.id(), bytes.NewReader(kdf.params()))
+		if err != nil {
+			t.Error(kdf, err)
+		}
+	}
+	// such parameters in a tampered secrets file would exhaust
+	// memory or never finish
+	for _, kdf := range []KDF{
+		pbkdf2KDF{iterations: 0},
+		pbkdf2KDF{iterations: 1 << 40},
+		scryptKDF{n: 1 << 40, r: 8, p: 1},
+		scryptKDF{n: 1 << 14, r: 1 << 30, p: 1},
+		scryptKDF{n: 1 << 14, r: 8, p: 1 << 29},
+		scryptKDF{n: 1 << 24, r: 16, p: 1},
+		scryptKDF{n: 3, r: 8, p: 1},
+	} {
+		_, err := readKDF(kdf.id(), bytes.NewReader(kdf.params()))
+		if err == nil {
+			t.Error("Accepted", kdf)
+		}
+	}
+	scaled := pbkdf2KDF{iterations: 1 << 20}.scale(1 << 20).(pbkdf2KDF)
+	if scaled.iterations != pbkdf2MaxIterations {
+		t.Error("Scaled PBKDF2 to", scaled)
+	}
+	scaledScrypt := scryptKDF{n: scryptMaxN, r: 8, p: 1}.scale(1 << 20).(scryptKDF)
+	if scaledScrypt.n*uint64(scaledScrypt.r)*uint64(scaledScrypt.p) > scryptMaxCost {
+		t.Error("Scaled scrypt to", scaledScrypt)
+	}
+}
+
+func TestCalibrateKDF(t *testing.T) {
+	if testing.Short() {
+		t.Skip("calibration takes several seconds")
+	}
+	kdf, err := CalibrateKDF(pbkdf2KDF{iterations: 131072})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kdf.(pbkdf2KDF); !ok {
+		t.Fatal("Calibration changed KDF type to", kdf)
+	}
+	t.Log(kdf)
+}
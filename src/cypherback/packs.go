@@ -0,0 +1,510 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+
+Pack files
+
+A PackBackend wraps another Backend and groups small chunks into pack
+objects, so that trees of many small files don't become millions of
+tiny objects.  Packs and their indices are stored through the wrapped
+backend's chunk methods, under names which cannot be chunk IDs:
+
+  pack-ID    the encrypted chunks, concatenated; each remains a
+             complete, independently authenticated chunk
+  index-ID   the index of pack-ID, encrypted and stored as a chunk
+
+An index's plaintext is:
+
+Byte Length
+  0    1    version (0)
+  1    4    length of the pack
+  5    4    number of entries
+  9    -    entries, each:
+              2    length of chunk ID
+              -    chunk ID
+              4    offset in pack
+              4    length
+
+A pack is always written before its index, so a crash can only leave
+a pack without an index, which CollectGarbage removes.  Chunks are
+never rewritten in place: deleting a packed chunk rewrites only the
+index, and Repack copies the live chunks of mostly-dead packs into new
+packs before deleting the old ones.
+
+*/
+
+const (
+	packPrefix  = "pack-"
+	indexPrefix = "index-"
+)
+
+type packLocation struct {
+	// empty while the chunk is waiting to be written in a pack
+	pack   string
+	offset uint32
+	length uint32
+}
+
+// the packing state of a single secrets file
+type packState struct {
+	secrets *Secrets
+	// chunk ID -> location; nil until loaded
+	index map[string]packLocation
+	// pack ID -> length of the pack
+	packLengths map[string]uint32
+	// packs whose indices must be rewritten
+	dirty   map[string]bool
+	pending bytes.Buffer
+	// the last pack read, since backends can only read whole objects
+	cachedPack string
+	cachedData []byte
+}
+
+// A PackBackend stores the chunks of the secrets it was given in pack
+// files in the Backend it wraps; everything else, and the chunks of
+// any other secrets, pass straight through.  Chunks which are already
+// in packs can always be read, whatever the pack size; new chunks are
+// only packed if it is non-zero.  Flush must be called once writing is
+// done, but WriteBackupSet does so itself, so that a backup set is
+// never written before its chunks.
+type PackBackend struct {
+	Backend
+	packSize int
+	states   map[string]*packState
+}
+
+// NewPackBackend wraps BACKEND, packing the chunks of SECRETS into
+// packs of about PACKSIZE bytes; chunks of PACKSIZE or more are stored
+// alone.  A PACKSIZE of zero disables packing, but not the reading of
+// existing packs.
+func NewPackBackend(backend Backend, packSize int, secrets ...*Secrets) *PackBackend {
+	p := &PackBackend{Backend: backend, packSize: packSize, states: make(map[string]*packState)}
+	for _, s := range secrets {
+		p.states[s.HexId()] = &packState{secrets: s}
+	}
+	return p
+}
+
+// isPackObject reports whether the chunk-store name ID is a pack or
+// an index, rather than a chunk
+func isPackObject(id string) bool {
+	return strings.HasPrefix(id, packPrefix) || strings.HasPrefix(id, indexPrefix)
+}
+
+// state returns the loaded packing state for SECRETSID, or nil if its
+// chunks aren't being handled
+func (p *PackBackend) state(secretsId string) (*packState, error) {
+	state, ok := p.states[secretsId]
+	if !ok {
+		return nil, nil
+	}
+	if state.index != nil {
+		return state, nil
+	}
+	index := make(map[string]packLocation)
+	packLengths := make(map[string]uint32)
+	ids, err := p.Backend.ListChunks(secretsId)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if !strings.HasPrefix(id, indexPrefix) {
+			continue
+		}
+		packId := packPrefix + id[len(indexPrefix):]
+		encIndex, err := p.Backend.ReadChunk(secretsId, id)
+		if err != nil {
+			return nil, err
+		}
+		packIndex, err := decryptChunk(state.secrets, encIndex)
+		if err != nil {
+			return nil, fmt.Errorf("Pack index %s: %v", id, err)
+		}
+		packLength, err := readPackIndex(packIndex, packId, index)
+		if err != nil {
+			return nil, fmt.Errorf("Pack index %s: %v", id, err)
+		}
+		packLengths[packId] = packLength
+	}
+	state.index = index
+	state.packLengths = packLengths
+	state.dirty = make(map[string]bool)
+	return state, nil
+}
+
+// readPackIndex adds the entries in the plaintext index of PACKID to
+// INDEX, returning the length of the pack
+func readPackIndex(packIndex []byte, packId string, index map[string]packLocation) (packLength uint32, err error) {
+	reader := bytes.NewReader(packIndex)
+	var version uint8
+	err = binary.Read(reader, binary.BigEndian, &version)
+	if err != nil {
+		return 0, err
+	}
+	if version != 0 {
+		return 0, fmt.Errorf("Unsupported index version %d", version)
+	}
+	var count uint32
+	err = binary.Read(reader, binary.BigEndian, &packLength)
+	if err != nil {
+		return 0, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &count)
+	if err != nil {
+		return 0, err
+	}
+	for i := uint32(0); i < count; i++ {
+		var idLength uint16
+		err = binary.Read(reader, binary.BigEndian, &idLength)
+		if err != nil {
+			return 0, err
+		}
+		id := make([]byte, idLength)
+		_, err = io.ReadFull(reader, id)
+		if err != nil {
+			return 0, err
+		}
+		location := packLocation{pack: packId}
+		err = binary.Read(reader, binary.BigEndian, &location.offset)
+		if err != nil {
+			return 0, err
+		}
+		err = binary.Read(reader, binary.BigEndian, &location.length)
+		if err != nil {
+			return 0, err
+		}
+		if uint64(location.offset)+uint64(location.length) > uint64(packLength) {
+			return 0, fmt.Errorf("Chunk %s lies outside its pack", id)
+		}
+		index[string(id)] = location
+	}
+	return packLength, nil
+}
+
+// writePackIndex writes the index of PACKID, deleting the pack and
+// its index instead if no chunks in it remain
+func (p *PackBackend) writePackIndex(secretsId string, state *packState, packId string) error {
+	entries := &bytes.Buffer{}
+	count := uint32(0)
+	for id, location := range state.index {
+		if location.pack != packId {
+			continue
+		}
+		binary.Write(entries, binary.BigEndian, uint16(len(id)))
+		entries.Write([]byte(id))
+		binary.Write(entries, binary.BigEndian, location.offset)
+		binary.Write(entries, binary.BigEndian, location.length)
+		count++
+	}
+	indexId := indexPrefix + packId[len(packPrefix):]
+	if count == 0 {
+		// the index goes first, so that no index ever refers to a
+		// missing pack
+		err := p.Backend.DeleteChunk(secretsId, indexId)
+		if err != nil {
+			return err
+		}
+		delete(state.packLengths, packId)
+		if state.cachedPack == packId {
+			state.cachedPack, state.cachedData = "", nil
+		}
+		return p.Backend.DeleteChunk(secretsId, packId)
+	}
+	packIndex := &bytes.Buffer{}
+	packIndex.Write([]byte{0}) // version
+	binary.Write(packIndex, binary.BigEndian, state.packLengths[packId])
+	binary.Write(packIndex, binary.BigEndian, count)
+	packIndex.Write(entries.Bytes())
+	encIndex, err := encryptChunk(state.secrets, packIndex.Bytes(), compressAuto, padRandom)
+	if err != nil {
+		return err
+	}
+	return p.Backend.WriteChunk(secretsId, indexId, encIndex)
+}
+
+// flushPending writes the chunks waiting to be packed as a new pack
+func (p *PackBackend) flushPending(secretsId string, state *packState) error {
+	if state.pending.Len() == 0 {
+		return nil
+	}
+	random, err := genNonce(24)
+	if err != nil {
+		return err
+	}
+	packId := packPrefix + hex.EncodeToString(random)
+	// backends may hold on to what they are given, so the buffer is
+	// replaced rather than reused
+	pack := state.pending.Bytes()
+	err = p.Backend.WriteChunk(secretsId, packId, pack)
+	if err != nil {
+		return err
+	}
+	for id, location := range state.index {
+		if location.pack == "" {
+			location.pack = packId
+			state.index[id] = location
+		}
+	}
+	state.packLengths[packId] = uint32(len(pack))
+	state.pending = bytes.Buffer{}
+	return p.writePackIndex(secretsId, state, packId)
+}
+
+// Flush writes any chunks waiting to be packed, and the indices of
+// any packs from which chunks have been deleted.
+func (p *PackBackend) Flush() error {
+	for secretsId, state := range p.states {
+		if state.index == nil {
+			continue
+		}
+		err := p.flushPending(secretsId, state)
+		if err != nil {
+			return err
+		}
+		for packId := range state.dirty {
+			err = p.writePackIndex(secretsId, state, packId)
+			if err != nil {
+				return err
+			}
+			delete(state.dirty, packId)
+		}
+	}
+	return nil
+}
+
+func (p *PackBackend) WriteBackupSet(secretsId, id string, data []byte) error {
+	err := p.Flush()
+	if err != nil {
+		return err
+	}
+	return p.Backend.WriteBackupSet(secretsId, id, data)
+}
+
+// AppendBackupSet appends in place if the wrapped backend can, once
+// any pending chunks are written.
+func (p *PackBackend) AppendBackupSet(secretsId, id string, offset int64, data []byte) error {
+	appender, ok := p.Backend.(BackupSetAppender)
+	if !ok {
+		return AppendNotSupported
+	}
+	err := p.Flush()
+	if err != nil {
+		return err
+	}
+	return appender.AppendBackupSet(secretsId, id, offset, data)
+}
+
+func (p *PackBackend) WriteChunk(secretsId, id string, data []byte) error {
+	if p.packSize == 0 || len(data) >= p.packSize {
+		return p.Backend.WriteChunk(secretsId, id, data)
+	}
+	state, err := p.state(secretsId)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return p.Backend.WriteChunk(secretsId, id, data)
+	}
+	// a chunk's ID is determined by its contents
+	if _, ok := state.index[id]; ok {
+		return nil
+	}
+	state.index[id] = packLocation{offset: uint32(state.pending.Len()), length: uint32(len(data))}
+	state.pending.Write(data)
+	if state.pending.Len() >= p.packSize {
+		return p.flushPending(secretsId, state)
+	}
+	return nil
+}
+
+func (p *PackBackend) ReadChunk(secretsId, id string) (data []byte, err error) {
+	state, err := p.state(secretsId)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return p.Backend.ReadChunk(secretsId, id)
+	}
+	location, ok := state.index[id]
+	if !ok {
+		return p.Backend.ReadChunk(secretsId, id)
+	}
+	var pack []byte
+	switch location.pack {
+	case "":
+		pack = state.pending.Bytes()
+	case state.cachedPack:
+		pack = state.cachedData
+	default:
+		pack, err = p.Backend.ReadChunk(secretsId, location.pack)
+		if err != nil {
+			return nil, err
+		}
+		state.cachedPack, state.cachedData = location.pack, pack
+	}
+	end := uint64(location.offset) + uint64(location.length)
+	if end > uint64(len(pack)) {
+		return nil, fmt.Errorf("Chunk %s lies outside pack %s", id, location.pack)
+	}
+	data = make([]byte, location.length)
+	copy(data, pack[location.offset:end])
+	return data, nil
+}
+
+func (p *PackBackend) ListChunks(secretsId string) (ids []string, err error) {
+	state, err := p.state(secretsId)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := p.Backend.ListChunks(secretsId)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range stored {
+		if isPackObject(id) {
+			continue
+		}
+		if state != nil {
+			if _, ok := state.index[id]; ok {
+				continue
+			}
+		}
+		ids = append(ids, id)
+	}
+	if state != nil {
+		for id := range state.index {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (p *PackBackend) DeleteChunk(secretsId, id string) error {
+	state, err := p.state(secretsId)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return p.Backend.DeleteChunk(secretsId, id)
+	}
+	location, ok := state.index[id]
+	if !ok {
+		return p.Backend.DeleteChunk(secretsId, id)
+	}
+	delete(state.index, id)
+	if location.pack != "" {
+		state.dirty[location.pack] = true
+	}
+	return nil
+}
+
+// Repack copies the live chunks of each pack of SECRETSID in which
+// less than MINLIVE (a fraction) of the bytes are still in use into
+// new packs, and deletes the old packs.
+func (p *PackBackend) Repack(secretsId string, minLive float64) (repacked int, err error) {
+	err = p.Flush()
+	if err != nil {
+		return 0, err
+	}
+	state, err := p.state(secretsId)
+	if err != nil || state == nil {
+		return 0, err
+	}
+	live := make(map[string]uint32)
+	for _, location := range state.index {
+		live[location.pack] += location.length
+	}
+	var sparse []string
+	for packId, length := range state.packLengths {
+		if float64(live[packId]) < minLive*float64(length) {
+			sparse = append(sparse, packId)
+		}
+	}
+	if len(sparse) == 0 {
+		return 0, nil
+	}
+	for _, packId := range sparse {
+		pack, err := p.Backend.ReadChunk(secretsId, packId)
+		if err != nil {
+			return 0, err
+		}
+		for id, location := range state.index {
+			if location.pack != packId {
+				continue
+			}
+			end := uint64(location.offset) + uint64(location.length)
+			if end > uint64(len(pack)) {
+				return 0, fmt.Errorf("Chunk %s lies outside pack %s", id, packId)
+			}
+			state.index[id] = packLocation{offset: uint32(state.pending.Len()), length: location.length}
+			state.pending.Write(pack[location.offset:end])
+		}
+	}
+	// the live chunks are safely in their new packs before the old
+	// packs are deleted
+	err = p.flushPending(secretsId, state)
+	if err != nil {
+		return 0, err
+	}
+	for _, packId := range sparse {
+		err = p.writePackIndex(secretsId, state, packId)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(sparse), nil
+}
+
+// removeOrphans deletes the packs of SECRETSID which have no index,
+// which are left if writing is interrupted between a pack and its
+// index
+func (p *PackBackend) removeOrphans(secretsId string) (removed int, err error) {
+	state, err := p.state(secretsId)
+	if err != nil || state == nil {
+		return 0, err
+	}
+	ids, err := p.Backend.ListChunks(secretsId)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if !strings.HasPrefix(id, packPrefix) {
+			continue
+		}
+		if _, ok := state.packLengths[id]; ok {
+			continue
+		}
+		err = p.Backend.DeleteChunk(secretsId, id)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	memoryBackend "cypherback/backends/memory"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// countObjects counts the packs and other objects stored under
+// SECRETSID in BACKEND
+func countObjects(t *testing.T, backend Backend, secretsId string) (packs, others int) {
+	ids, err := backend.ListChunks(secretsId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		switch {
+		case strings.HasPrefix(id, packPrefix):
+			packs++
+		case !strings.HasPrefix(id, indexPrefix):
+			others++
+		}
+	}
+	return packs, others
+}
+
+func TestPackBackend(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsId := secrets.HexId()
+	backend := memoryBackend.New()
+	packs := NewPackBackend(backend, 1024, secrets)
+	chunks := make(map[string][]byte)
+	for i := 0; i < 40; i++ {
+		id := fmt.Sprintf("%096x", i)
+		chunks[id] = bytes.Repeat([]byte{byte(i)}, 100)
+		err = packs.WriteChunk(secretsId, id, chunks[id])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// too big to pack
+	bigId := fmt.Sprintf("%096x", 1000)
+	chunks[bigId] = make([]byte, 2048)
+	err = packs.WriteChunk(secretsId, bigId, chunks[bigId])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = packs.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packCount, others := countObjects(t, backend, secretsId)
+	if packCount != 4 || others != 1 {
+		t.Error("Stored", packCount, "packs and", others, "other chunks")
+	}
+
+	// a fresh PackBackend must find everything from the indices
+	packs = NewPackBackend(backend, 1024, secrets)
+	ids, err := packs.ListChunks(secretsId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(chunks) {
+		t.Error("Listed", len(ids), "chunks, not", len(chunks))
+	}
+	for id, chunk := range chunks {
+		data, err := packs.ReadChunk(secretsId, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, chunk) {
+			t.Error("Chunk", id, "read back as", data)
+		}
+	}
+
+	// delete all but one chunk of every pack; the first pack loses
+	// everything
+	for i := 0; i < 40; i++ {
+		if i%10 == 9 && i != 9 {
+			continue
+		}
+		id := fmt.Sprintf("%096x", i)
+		err = packs.DeleteChunk(secretsId, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(chunks, id)
+	}
+	repacked, err := packs.Repack(secretsId, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repacked != 3 {
+		t.Error("Repacked", repacked, "packs")
+	}
+	packCount, _ = countObjects(t, backend, secretsId)
+	if packCount != 1 {
+		t.Error(packCount, "packs remain after repacking")
+	}
+	packs = NewPackBackend(backend, 1024, secrets)
+	for id, chunk := range chunks {
+		data, err := packs.ReadChunk(secretsId, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, chunk) {
+			t.Error("Chunk", id, "read back as", data, "after repacking")
+		}
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "file"), []byte("some file contents"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsId := secrets.HexId()
+	stored := memoryBackend.New()
+	backend := NewPackBackend(stored, 1<<20, secrets)
+	set, err := newBackupSet("foo", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.StartBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ProcessPath(set, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.EndBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreferenced := fmt.Sprintf("%096x", 0)
+	err = backend.WriteChunk(secretsId, unreferenced, []byte("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CollectGarbage(backend, secrets, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := backend.ListChunks(secretsId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] == unreferenced {
+		t.Error("Chunks after collection:", ids)
+	}
+	err = CheckBackupSets(backend, secrets, ioutil.Discard)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// collecting without the PackBackend must leave packs alone
+	err = CollectGarbage(stored, secrets, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckBackupSets(NewPackBackend(stored, 1<<20, secrets), secrets, ioutil.Discard)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// An OwnerPolicy selects how restored files' owners are chosen
+type OwnerPolicy int
+
+const (
+	// OwnersByName gives files the users and groups of the same
+	// names on the restoring system, falling back to the recorded
+	// IDs for names it does not know
+	OwnersByName OwnerPolicy = iota
+	// OwnersNumeric gives files the recorded user and group IDs
+	OwnersNumeric
+)
+
+// ParseOwnerPolicy returns the owner policy called NAME: names or
+// numeric
+func ParseOwnerPolicy(name string) (OwnerPolicy, error) {
+	switch name {
+	case "names":
+		return OwnersByName, nil
+	case "numeric":
+		return OwnersNumeric, nil
+	}
+	return 0, fmt.Errorf("Unknown owner policy %s", name)
+}
+
+// RestoreOptions control how files' metadata are restored
+type RestoreOptions struct {
+	Owners OwnerPolicy
+	// users and groups, by recorded name or ID, to be given to
+	// the named or numbered user or group instead
+	UserMap  map[string]string
+	GroupMap map[string]string
+	// Report, if set, is called with each failure to restore a
+	// file's owner, mode, times or attributes, and restoring
+	// continues; otherwise the first such failure ends it
+	Report func(path string, err error)
+}
+
+// AddOwnerMapping adds the mapping OLD:NEW in MAPPING to MAP
+func AddOwnerMapping(mappings map[string]string, mapping string) error {
+	i := strings.Index(mapping, ":")
+	if i <= 0 || i == len(mapping)-1 {
+		return fmt.Errorf("Invalid mapping %q: expected OLD:NEW", mapping)
+	}
+	mappings[mapping[:i]] = mapping[i+1:]
+	return nil
+}
+
+// A restorer holds what restoring records needs
+type restorer struct {
+	readChunk readChunk
+	options   RestoreOptions
+	// only root may give files away or create devices
+	root bool
+	// hard links whose targets did not yet exist
+	pendingLinks []hardLinkInfo
+}
+
+func newRestorer(backend Backend, secrets *Secrets, options *RestoreOptions) *restorer {
+	r := &restorer{readChunk: chunkReader(backend, secrets), root: os.Geteuid() == 0}
+	if options != nil {
+		r.options = *options
+	}
+	return r
+}
+
+// report reports each of ERRS, any of which may be nil, as a failure
+// to restore PATH
+func (r *restorer) report(path string, errs ...error) error {
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if r.options.Report == nil {
+			return fmt.Errorf("Cannot restore %s: %v", path, err)
+		}
+		r.options.Report(path, err)
+	}
+	return nil
+}
+
+func lookupUserId(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGroupId(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// resolveId returns the ID on this system for the user or group
+// recorded as ID and NAME, which MAPPINGS may map to another name or
+// ID, and LOOKUP looks up by name
+func (r *restorer) resolveId(id uint32, name string, mappings map[string]string, lookup func(string) (string, error)) (int, error) {
+	var mapped string
+	var ok bool
+	if name != "" {
+		mapped, ok = mappings[name]
+	}
+	if !ok {
+		mapped, ok = mappings[strconv.FormatUint(uint64(id), 10)]
+	}
+	if ok {
+		if newId, err := strconv.Atoi(mapped); err == nil {
+			return newId, nil
+		}
+		newId, err := lookup(mapped)
+		if err != nil {
+			return 0, fmt.Errorf("Cannot map %s to %s: %v", name, mapped, err)
+		}
+		return strconv.Atoi(newId)
+	}
+	if r.options.Owners == OwnersNumeric || name == "" {
+		return int(id), nil
+	}
+	newId, err := lookup(name)
+	if err != nil {
+		return int(id), nil
+	}
+	return strconv.Atoi(newId)
+}
+
+// restoreOwner gives the file described by INFO its owner, if
+// running as root, without following a symlink
+func (r *restorer) restoreOwner(info baseFileInfo) error {
+	if !r.root {
+		return nil
+	}
+	uid, err := r.resolveId(info.uid, info.userName, r.options.UserMap, lookupUserId)
+	if err != nil {
+		return err
+	}
+	gid, err := r.resolveId(info.gid, info.groupName, r.options.GroupMap, lookupGroupId)
+	if err != nil {
+		return err
+	}
+	return os.Lchown(info.name, uid, gid)
+}
+
+// finish creates the hard links whose targets were only restored
+// after them
+func (r *restorer) finish() error {
+	for _, link := range r.pendingLinks {
+		err := r.report(link.name, link.link())
+		if err != nil {
+			return err
+		}
+	}
+	r.pendingLinks = nil
+	return nil
+}
+
+// removeExisting removes whatever other than a directory is at PATH,
+// so that it can be replaced
+func removeExisting(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return os.Remove(path)
+}
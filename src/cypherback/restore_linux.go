@@ -0,0 +1,73 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// missing from package syscall
+const (
+	atFdcwd           = -100
+	atSymlinkNofollow = 0x100
+)
+
+// lchtimes sets the access and modification times of PATH without
+// following a final symlink
+func lchtimes(path string, aTime, mTime time.Time) error {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	times := [2]syscall.Timespec{
+		syscall.NsecToTimespec(aTime.UnixNano()),
+		syscall.NsecToTimespec(mTime.UnixNano()),
+	}
+	fd := atFdcwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd), uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&times[0])), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "utimensat", Path: path, Err: errno}
+	}
+	return nil
+}
+
+// mkfifo creates a FIFO at PATH with permissions MODE
+func mkfifo(path string, mode os.FileMode) error {
+	err := syscall.Mkfifo(path, uint32(mode.Perm()))
+	if err != nil {
+		return &os.PathError{Op: "mkfifo", Path: path, Err: err}
+	}
+	return nil
+}
+
+// mknod creates a device node at PATH with permissions MODE for the
+// device RDEV; a character device if CHAR, otherwise a block device
+func mknod(path string, mode os.FileMode, char bool, rdev uint64) error {
+	kind := uint32(syscall.S_IFBLK)
+	if char {
+		kind = syscall.S_IFCHR
+	}
+	err := syscall.Mknod(path, kind|uint32(mode.Perm()), int(rdev))
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package cypherback
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Special files are only restored on Linux.
+
+func lchtimes(path string, aTime, mTime time.Time) error {
+	return nil
+}
+
+func mkfifo(path string, mode os.FileMode) error {
+	return fmt.Errorf("Cannot create FIFO %s on this platform", path)
+}
+
+func mknod(path string, mode os.FileMode, char bool, rdev uint64) error {
+	return fmt.Errorf("Cannot create device %s on this platform", path)
+}
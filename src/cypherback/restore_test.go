@@ -0,0 +1,287 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestResolveId(t *testing.T) {
+	r := &restorer{}
+	userMap := map[string]string{}
+	for _, mapping := range []string{"alice:root", "1001:4242"} {
+		err := AddOwnerMapping(userMap, mapping)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if AddOwnerMapping(userMap, "alice") == nil || AddOwnerMapping(userMap, ":root") == nil {
+		t.Error("Accepted an invalid mapping")
+	}
+	for _, test := range []struct {
+		policy OwnerPolicy
+		id     uint32
+		name   string
+		want   int
+	}{
+		{OwnersByName, 1000, "alice", 0},
+		{OwnersByName, 1001, "bob", 4242},
+		{OwnersByName, 1002, "root", 0},
+		{OwnersNumeric, 1002, "root", 1002},
+		{OwnersByName, 1003, "no-such-user-here", 1003},
+		{OwnersByName, 1004, "", 1004},
+	} {
+		r.options.Owners = test.policy
+		id, err := r.resolveId(test.id, test.name, userMap, lookupUserId)
+		if err != nil || id != test.want {
+			t.Error("Resolved", test.id, test.name, "as", id, err, "not", test.want)
+		}
+	}
+	_, err := r.resolveId(1000, "carol", map[string]string{"carol": "no-such-user-here"}, lookupUserId)
+	if err == nil {
+		t.Error("Mapped to an unknown user")
+	}
+}
+
+func TestGroupName(t *testing.T) {
+	info, err := os.Lstat(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gid := info.Sys().(*syscall.Stat_t).Gid
+	group, err := user.LookupGroupId(fmt.Sprint(gid))
+	if err != nil {
+		t.Skip("The group of . has no name")
+	}
+	b := &BackupSet{}
+	if base := b.newBaseFileInfo(".", info); base.groupName != group.Name {
+		t.Error("Recorded group", base.groupName, "not", group.Name)
+	}
+}
+
+func TestRestoreReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := baseFileInfo{name: filepath.Join(dir, "missing"), mode: 0644, mTime: time.Now()}
+	r := &restorer{}
+	if missing.Restore(r) == nil {
+		t.Error("Restoring a missing file's metadata succeeded")
+	}
+	reported := 0
+	r.options.Report = func(path string, err error) {
+		if path != missing.name {
+			t.Error("Reported", path)
+		}
+		reported++
+	}
+	err = missing.Restore(r)
+	if err != nil || reported != 2 {
+		t.Error("Restoring returned", err, "and reported", reported, "failures")
+	}
+
+	if os.Geteuid() != 0 {
+		return
+	}
+	path := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(path, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := baseFileInfo{name: path, mode: 0600, uid: 1000, gid: 1000, userName: "alice"}
+	r = &restorer{root: true}
+	r.options.UserMap = map[string]string{"alice": "4242"}
+	err = file.Restore(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 4242 || stat.Gid != 1000 {
+		t.Error("Restored owner", stat.Uid, stat.Gid)
+	}
+}
+
+func TestRestoreSpecialFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	mTime := time.Unix(1234567890, 0)
+	records := []fileRecord{
+		// a link restored before its target
+		hardLinkInfo{name: path("link"), linkPath: path("file")},
+		regularFileInfo{baseFileInfo: baseFileInfo{name: path("file"), mode: 0640, mTime: mTime}},
+		symLinkInfo{baseFileInfo{name: path("symlink"), mode: os.ModeSymlink | 0777, aTime: mTime, mTime: mTime}, "file"},
+		fifoInfo{baseFileInfo{name: path("fifo"), mode: os.ModeNamedPipe | 0600, mTime: mTime}},
+		charDeviceInfo{deviceInfo{baseFileInfo{name: path("null"), mode: os.ModeDevice | os.ModeCharDevice | 0666, mTime: mTime}, 0x103}},
+	}
+	var failed []string
+	r := &restorer{root: os.Geteuid() == 0}
+	r.options.Report = func(path string, err error) {
+		failed = append(failed, path)
+	}
+	for _, record := range records {
+		err = record.Restore(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = r.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Lstat(path("file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Lstat(path("link"))
+	if err != nil || !os.SameFile(file, link) {
+		t.Error("Hard link not restored:", err)
+	}
+	target, err := os.Readlink(path("symlink"))
+	if err != nil || target != "file" {
+		t.Error("Symlink restored to", target, err)
+	}
+	symlink, err := os.Lstat(path("symlink"))
+	if err != nil || !symlink.ModTime().Equal(mTime) {
+		t.Error("Symlink times not restored:", err)
+	}
+	if !file.ModTime().Equal(mTime) {
+		t.Error("Following the symlink changed its target's times")
+	}
+	fifo, err := os.Lstat(path("fifo"))
+	if err != nil || fifo.Mode() != os.ModeNamedPipe|0600 {
+		t.Error("FIFO not restored:", err)
+	}
+	device, err := os.Lstat(path("null"))
+	if r.root {
+		if err != nil || device.Mode()&os.ModeCharDevice == 0 || device.Sys().(*syscall.Stat_t).Rdev != 0x103 {
+			t.Error("Device not restored:", err)
+		}
+		if len(failed) != 0 {
+			t.Error("Failed to restore", failed)
+		}
+	} else if err == nil || len(failed) != 1 || failed[0] != path("null") {
+		t.Error("Restored a device without root, reporting", failed)
+	}
+}
+
+func TestSymLinkRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "symlink")
+	err = os.Symlink("target", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &BackupSet{hardLinks: make(map[devInode]string)}
+	record, err := b.fileRecordFromFileInfo(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	symlink, ok := record.(*symLinkInfo)
+	if !ok || symlink.name != path || symlink.linkPath != "target" {
+		t.Error("Recorded symlink as", record)
+	}
+}
+
+func TestRestoreOverLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	// what earlier runs left behind
+	err = ioutil.WriteFile(path("target"), []byte("not to be overwritten"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(path("targetdir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []struct{ name, target string }{{"symlink", "target"}, {"dirlink", "targetdir"}} {
+		err = os.Symlink(link.target, path(link.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Link(path("target"), path("hardlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mTime := time.Unix(1234567890, 0)
+	records := []fileRecord{
+		regularFileInfo{baseFileInfo: baseFileInfo{name: path("symlink"), mode: 0640, mTime: mTime}},
+		regularFileInfo{baseFileInfo: baseFileInfo{name: path("hardlink"), mode: 0640, mTime: mTime}},
+		directoryInfo{baseFileInfo{name: path("dirlink"), mode: os.ModeDir | 0700, mTime: mTime}},
+	}
+	r := &restorer{root: os.Geteuid() == 0}
+	for _, record := range records {
+		err = record.Restore(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"symlink", "hardlink"} {
+		info, err := os.Lstat(path(name))
+		if err != nil || !info.Mode().IsRegular() || info.Size() != 0 || info.Sys().(*syscall.Stat_t).Nlink != 1 {
+			t.Error(name, "not replaced by a new file:", err)
+		}
+	}
+	data, err := ioutil.ReadFile(path("target"))
+	if err != nil || string(data) != "not to be overwritten" {
+		t.Errorf("Restoring wrote %q through a link: %v", data, err)
+	}
+	info, err := os.Lstat(path("dirlink"))
+	if err != nil || !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Error("Symlink not replaced by a directory:", err)
+	}
+	info, err = os.Stat(path("targetdir"))
+	if err != nil || info.Mode().Perm() != 0755 || info.ModTime().Equal(mTime) {
+		t.Error("Restoring a directory changed a symlink's target")
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// RotateSecrets re-encrypts every backup set and chunk stored under
+// OLDSECRETS in BACKEND under NEWSECRETS, then verifies every
+// re-encrypted backup set and chunk.  Nothing stored under OLDSECRETS
+// is altered, and a backup set is not written until all its chunks
+// have been, so an interrupted rotation is resumed simply by calling
+// RotateSecrets again with the same secrets: backup sets which have
+// already been rotated are skipped.  Progress is reported to
+// PROGRESS.
+func RotateSecrets(backend Backend, oldSecrets, newSecrets *Secrets, progress io.Writer) error {
+	oldId := oldSecrets.HexId()
+	setIds, err := listBackupSets(backend, oldId)
+	if err != nil {
+		return err
+	}
+	// old chunk ID -> new chunk ID
+	rotated := make(map[string]string)
+	verified := make(map[string]bool)
+	var newSetIds []string
+	for i, setId := range setIds {
+		set, err := loadBackupSet(backend, oldSecrets, setId)
+		if err != nil {
+			return fmt.Errorf("Backup set %s: %v", setId, err)
+		}
+		newSetId := tagToId(newSecrets, set.tag)
+		newSetIds = append(newSetIds, newSetId)
+		if verifyBackupSet(backend, newSecrets, newSetId, verified) == nil {
+			fmt.Fprintf(progress, "Backup set %d of %d has already been rotated\n", i+1, len(setIds))
+			continue
+		}
+		fmt.Fprintf(progress, "Rotating backup set %d of %d\n", i+1, len(setIds))
+		newSet := &BackupSet{tag: set.tag, secrets: newSecrets, padding: padRandom}
+		start := 0
+		for _, record := range set.records {
+			switch record := record.(type) {
+			case startRecord:
+				start = len(newSet.records)
+			case regularFileInfo:
+				newChunks := make([]string, len(record.chunks))
+				for j, chunk := range record.chunks {
+					newChunk, ok := rotated[chunk]
+					if !ok {
+						newChunk, err = rotateChunk(backend, oldSecrets, newSecrets, chunk)
+						if err != nil {
+							return err
+						}
+						rotated[chunk] = newChunk
+					}
+					newChunks[j] = newChunk
+				}
+				record.chunks = newChunks
+				newSet.records = append(newSet.records, record)
+				continue
+			case endRecord:
+				// chunk IDs have changed, so the run digest has
+				// too, and records may have changed length
+				// since the set was written
+				first, ok := newSet.records[start].(startRecord)
+				if ok {
+					first.length = runLength(newSet.records[start:])
+					newSet.records[start] = first
+				}
+				hash, err := runDigest(newSet.records[start:])
+				if err != nil {
+					return err
+				}
+				newSet.records = append(newSet.records, endRecord{hash})
+				continue
+			}
+			newSet.records = append(newSet.records, record)
+		}
+		err = newSet.writeMetadata(backend)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(progress, "Verifying rotated backup sets")
+	for _, newSetId := range newSetIds {
+		err = verifyBackupSet(backend, newSecrets, newSetId, verified)
+		if err != nil {
+			return fmt.Errorf("Verification of rotated backup set %s failed: %v", newSetId, err)
+		}
+	}
+	return nil
+}
+
+// rotateChunk re-encrypts the chunk ID under NEWSECRETS, returning its
+// new ID
+func rotateChunk(backend Backend, oldSecrets, newSecrets *Secrets, id string) (newId string, err error) {
+	chunk, err := backend.ReadChunk(oldSecrets.HexId(), id)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := decryptChunk(oldSecrets, chunk)
+	if err != nil {
+		return "", fmt.Errorf("Chunk %s: %v", id, err)
+	}
+	if chunkStorageId(oldSecrets, plaintext) != id {
+		return "", fmt.Errorf("Chunk %s does not match its contents", id)
+	}
+	newId = chunkStorageId(newSecrets, plaintext)
+	encChunk, err := encryptChunk(newSecrets, plaintext, compressAuto, padRandom)
+	if err != nil {
+		return "", err
+	}
+	return newId, backend.WriteChunk(newSecrets.HexId(), newId, encChunk)
+}
+
+// verifyBackupSet checks that the backup set ID can be read and
+// authenticated, that each run's digest is correct, and that each of
+// its chunks can be read, authenticated and matches its ID.  Chunks
+// in VERIFIED are skipped, and chunks which verify are added to it.
+func verifyBackupSet(backend Backend, secrets *Secrets, id string, verified map[string]bool) error {
+	secretsId := secrets.HexId()
+	set, err := loadBackupSet(backend, secrets, id)
+	if err != nil {
+		return err
+	}
+	start := 0
+	for i, record := range set.records {
+		switch record := record.(type) {
+		case startRecord:
+			start = i
+		case endRecord:
+			hash, err := runDigest(set.records[start:i])
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(record.hash, hash) {
+				return fmt.Errorf("Run digest does not match")
+			}
+		case regularFileInfo:
+			for _, chunkId := range record.chunks {
+				if verified[chunkId] {
+					continue
+				}
+				chunk, err := backend.ReadChunk(secretsId, chunkId)
+				if err != nil {
+					return err
+				}
+				plaintext, err := decryptChunk(secrets, chunk)
+				if err != nil {
+					return fmt.Errorf("Chunk %s: %v", chunkId, err)
+				}
+				if chunkStorageId(secrets, plaintext) != chunkId {
+					return fmt.Errorf("Chunk %s does not match its contents", chunkId)
+				}
+				verified[chunkId] = true
+			}
+		}
+	}
+	return nil
+}
+
+// RetireSecrets deletes the secrets file OLDID and every backup set and
+// chunk stored under it, making NEWID the default if OLDID was.  It
+// must only be called once RotateSecrets has succeeded.
+func RetireSecrets(backend Backend, oldId, newId string) error {
+	defaultId, err := backend.DefaultSecretsId()
+	if err == nil && defaultId == oldId {
+		err = backend.SetDefaultSecrets(newId)
+		if err != nil {
+			return err
+		}
+	}
+	setIds, err := backend.ListBackupSets(oldId)
+	if err != nil {
+		return err
+	}
+	for _, setId := range setIds {
+		err = backend.DeleteBackupSet(oldId, setId)
+		if err != nil {
+			return err
+		}
+	}
+	chunkIds, err := backend.ListChunks(oldId)
+	if err != nil {
+		return err
+	}
+	for _, chunkId := range chunkIds {
+		err = backend.DeleteChunk(oldId, chunkId)
+		if err != nil {
+			return err
+		}
+	}
+	// the secrets file goes last, so that an interrupted retirement
+	// can be finished
+	return backend.DeleteSecrets(oldId)
+}
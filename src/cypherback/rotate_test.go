@@ -0,0 +1,103 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	memoryBackend "cypherback/backends/memory"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "file"), []byte("some file contents"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := memoryBackend.New()
+	oldSecrets, err := generateSecrets()
+	defer ZeroSecrets(oldSecrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.WriteSecrets(oldSecrets.HexId(), []byte("old secrets"))
+	set, err := EnsureBackupSet(backend, oldSecrets, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.StartBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ProcessPath(set, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.EndBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newSecrets, err := generateSecrets()
+	defer ZeroSecrets(newSecrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.WriteSecrets(newSecrets.HexId(), []byte("new secrets"))
+	err = RotateSecrets(backend, oldSecrets, newSecrets, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// resuming a completed rotation is harmless
+	err = RotateSecrets(backend, oldSecrets, newSecrets, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RetireSecrets(backend, oldSecrets.HexId(), newSecrets.HexId())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultId, err := backend.DefaultSecretsId()
+	if err != nil || defaultId != newSecrets.HexId() {
+		t.Error("New secrets are not the default", err)
+	}
+	chunks, _ := backend.ListChunks(oldSecrets.HexId())
+	sets, _ := backend.ListBackupSets(oldSecrets.HexId())
+	if len(chunks) != 0 || len(sets) != 0 {
+		t.Error("Old chunks or backup sets remain")
+	}
+	rotated, err := ReadBackupSet(backend, newSecrets, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated.records) != len(set.records) {
+		t.Error("Rotated backup set has", len(rotated.records), "records, not", len(set.records))
+	}
+}
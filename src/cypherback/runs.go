@@ -0,0 +1,375 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+
+Backup set index and run objects
+
+From version 4, a backup set's records are not stored in the set
+itself.  Each run is stored as its own object, alongside the set and
+named SETID-run-RUNID, and the set holds only its header and an index
+of its runs, so that the latest run can be read without the rest and
+runs can be pruned without rewriting the others.  The index is
+segmented exactly as a version 3 set's records are, so adding a run
+appends to it in place where the backend allows.
+
+Each index entry is:
+
+Byte Length
+  0    1    version (0)
+  1   24    run ID
+ 25    8    date of the run's start record
+ 33    8    length of the run's records
+ 41   48    SHA-384 of the run object
+
+A run object is sealed as a version 2 backup set is, with its own
+nonce, but its plaintext is just the run's records.  The digest in
+the index ties each run object to its set, so a run cannot be swapped
+for another or replayed.  Run objects are written before the index
+which refers to them, and deleted after it no longer does, so that a
+crash can only leave unreferenced run objects, which CollectGarbage
+removes.
+
+*/
+
+const (
+	indexedVersion = 4
+	runSeparator   = "-run-"
+	runIdLength    = 24
+	runEntryLength = 1 + runIdLength + 8 + 8 + sha512.Size384
+)
+
+// A runInfo is a backup set index entry
+type runInfo struct {
+	id     []byte
+	date   time.Time
+	length uint64
+	digest []byte
+}
+
+// runObjectId returns the name of run RUNID of the set SETID
+func runObjectId(setId string, runId []byte) string {
+	return setId + runSeparator + hex.EncodeToString(runId)
+}
+
+// isRunObject reports whether the backup set store name ID is a run,
+// rather than a set
+func isRunObject(id string) bool {
+	return strings.Contains(id, runSeparator)
+}
+
+// listBackupSets returns the IDs of the backup sets of SECRETSID,
+// without their runs or the catalog
+func listBackupSets(backend Backend, secretsId string) (setIds []string, err error) {
+	ids, err := backend.ListBackupSets(secretsId)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if !isRunObject(id) && id != catalogId {
+			setIds = append(setIds, id)
+		}
+	}
+	return setIds, nil
+}
+
+// writeRunIndex writes an index entry for each of RUNS to WRITER
+func writeRunIndex(writer io.Writer, runs []runInfo) error {
+	for _, run := range runs {
+		entry := make([]byte, 0, runEntryLength)
+		entry = append(entry, 0) // version
+		entry = append(entry, run.id...)
+		buffer := bytes.NewBuffer(entry)
+		binary.Write(buffer, binary.BigEndian, run.date.Unix())
+		binary.Write(buffer, binary.BigEndian, run.length)
+		buffer.Write(run.digest)
+		if buffer.Len() != runEntryLength {
+			return fmt.Errorf("Malformed index entry for run %x", run.id)
+		}
+		_, err := writer.Write(buffer.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRunIndex reads LENGTH bytes of index entries from READER
+func readRunIndex(reader io.Reader, length uint64) (runs []runInfo, err error) {
+	if length%runEntryLength != 0 {
+		return nil, fmt.Errorf("Error decoding backup set: index of %d bytes", length)
+	}
+	entry := make([]byte, runEntryLength)
+	for ; length > 0; length -= runEntryLength {
+		_, err = io.ReadFull(reader, entry)
+		if err != nil {
+			return nil, err
+		}
+		if entry[0] != 0 {
+			return nil, fmt.Errorf("Error decoding backup set: unknown index entry version %d", entry[0])
+		}
+		run := runInfo{id: make([]byte, runIdLength), digest: make([]byte, sha512.Size384)}
+		copy(run.id, entry[1:])
+		run.date = time.Unix(int64(binary.BigEndian.Uint64(entry[1+runIdLength:])), 0)
+		run.length = binary.BigEndian.Uint64(entry[1+runIdLength+8:])
+		copy(run.digest, entry[1+runIdLength+16:])
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// sealMetadata encrypts and authenticates PLAINTEXT, padded according
+// to PAD, under the metadata keys of SECRETS and a new nonce
+func sealMetadata(secrets *Secrets, plaintext []byte, pad padding) ([]byte, error) {
+	nonce, err := genNonce(48)
+	if err != nil {
+		return nil, err
+	}
+	keyMat := nistConcatKDF(secrets.metadataMaster, []byte("metadata encryption"), nonce, 48)
+	defer keyMat.wipe()
+	aesCypher, err := aes.NewCipher(keyMat[0:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(aesCypher)
+	if err != nil {
+		return nil, err
+	}
+	padded, err := padPlaintext(plaintext, pad)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte{paddedVersion}, nonce...)
+	data := aead.Seal(header, keyMat[32:32+aead.NonceSize()], padded, header)
+	digester := hmac.New(sha512.New384, secrets.metadataAuthentication)
+	digester.Write(data)
+	return digester.Sum(data), nil
+}
+
+// openMetadata authenticates and decrypts DATA, sealed by
+// sealMetadata.  The plaintext is returned whole, alongside DATA.
+func openMetadata(secrets *Secrets, data []byte) ([]byte, error) {
+	authLength := len(data) - sha512.Size384
+	if authLength < 1+48 {
+		return nil, fmt.Errorf("Sealed metadata is only %d bytes long", len(data))
+	}
+	if data[0] != paddedVersion {
+		return nil, fmt.Errorf("Unsupported metadata version %d", data[0])
+	}
+	digester := hmac.New(sha512.New384, secrets.metadataAuthentication)
+	digester.Write(data[:authLength])
+	if !hmac.Equal(data[authLength:], digester.Sum(nil)) {
+		return nil, fmt.Errorf("Invalid authentication tag")
+	}
+	keyMat := nistConcatKDF(secrets.metadataMaster, []byte("metadata encryption"), data[1:1+48], 48)
+	defer keyMat.wipe()
+	aesCypher, err := aes.NewCipher(keyMat[0:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(aesCypher)
+	if err != nil {
+		return nil, err
+	}
+	padded, err := aead.Open(nil, keyMat[32:32+aead.NonceSize()], data[1+48:authLength], data[:1+48])
+	if err != nil {
+		return nil, err
+	}
+	return unpadPlaintext(padded)
+}
+
+// writeRun stores RECORDS, a complete run of the set SETID, as a run
+// object, returning its index entry
+func (b *BackupSet) writeRun(backend Backend, setId string, records []fileRecord) (run runInfo, err error) {
+	start, ok := records[0].(startRecord)
+	if !ok {
+		return run, fmt.Errorf("Run does not begin with a start record")
+	}
+	plaintext := &bytes.Buffer{}
+	err = writeRecords(plaintext, records)
+	if err != nil {
+		return run, err
+	}
+	data, err := sealMetadata(b.secrets, plaintext.Bytes(), b.padding)
+	if err != nil {
+		return run, err
+	}
+	run.id, err = genNonce(runIdLength)
+	if err != nil {
+		return run, err
+	}
+	run.date = start.date
+	run.length = uint64(plaintext.Len())
+	digest := sha512.Sum384(data)
+	run.digest = digest[:]
+	return run, backend.WriteBackupSet(b.secrets.HexId(), runObjectId(setId, run.id), data)
+}
+
+// streamRun authenticates and decrypts RUN, from the set's index, and
+// calls FN with each of its records
+func (b *BackupSet) streamRun(backend Backend, run runInfo, fn recordFunc) error {
+	setId := tagToId(b.secrets, b.tag)
+	data, err := backend.ReadBackupSet(b.secrets.HexId(), runObjectId(setId, run.id))
+	if err != nil {
+		return err
+	}
+	digest := sha512.Sum384(data)
+	if !hmac.Equal(digest[:], run.digest) {
+		return fmt.Errorf("Run %x does not match the backup set index", run.id)
+	}
+	plaintext, err := openMetadata(b.secrets, data)
+	if err != nil {
+		return fmt.Errorf("Run %x: %v", run.id, err)
+	}
+	if uint64(len(plaintext)) != run.length {
+		return fmt.Errorf("Run %x is %d bytes long, not %d", run.id, len(plaintext), run.length)
+	}
+	err = streamRecords(bytes.NewReader(plaintext), fn)
+	if err != nil {
+		return fmt.Errorf("Run %x: %v", run.id, err)
+	}
+	return nil
+}
+
+// loadRuns reads RUNS, from the set's index, and adds their records
+// to the set
+func (b *BackupSet) loadRuns(backend Backend, runs []runInfo) error {
+	for _, run := range runs {
+		err := b.streamRun(backend, run, func(record fileRecord) error {
+			b.records = append(b.records, record)
+			b.encodedRecords++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBackupSet reads the backup set ID of SECRETS, returning
+// NoSuchBackupSet if there is none; if it has an index, none of its
+// runs are loaded
+func readBackupSet(backend Backend, secrets *Secrets, id string) (*BackupSet, error) {
+	data, err := backend.ReadBackupSet(secrets.HexId(), id)
+	if os.IsNotExist(err) {
+		return nil, NoSuchBackupSet
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := decodeBackupSet(secrets, data)
+	if err != nil {
+		return nil, err
+	}
+	if tagToId(secrets, b.tag) != id {
+		return nil, fmt.Errorf("Backup set %s holds the set tagged %q", id, b.tag)
+	}
+	return b, nil
+}
+
+// loadBackupSet reads the backup set ID of SECRETS and all its runs
+func loadBackupSet(backend Backend, secrets *Secrets, id string) (*BackupSet, error) {
+	b, err := readBackupSet(backend, secrets, id)
+	if err != nil {
+		return nil, err
+	}
+	err = b.loadRuns(backend, b.runs)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ReadBackupSetRuns reads the backup set tagged TAG, with only its
+// COUNT most recent runs, or all of them if COUNT is zero.
+func ReadBackupSetRuns(backend Backend, secrets *Secrets, tag string, count int) (*BackupSet, error) {
+	b, err := readBackupSet(backend, secrets, tagToId(secrets, tag))
+	if err != nil {
+		return nil, err
+	}
+	runs := b.runs
+	if count > 0 && count < len(runs) {
+		runs = runs[len(runs)-count:]
+	}
+	err = b.loadRuns(backend, runs)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// PruneBackupSet deletes all but the KEEP most recent runs of the
+// backup set tagged TAG, returning how many were deleted.  Only the
+// index is rewritten.  Chunks to which only the deleted runs referred
+// remain until CollectGarbage is run.
+func PruneBackupSet(backend Backend, secrets *Secrets, tag string, keep int) (pruned int, err error) {
+	if keep < 1 {
+		return 0, fmt.Errorf("Cannot keep %d runs", keep)
+	}
+	b, err := readBackupSet(backend, secrets, tagToId(secrets, tag))
+	if err != nil {
+		return 0, err
+	}
+	if b.encoded == nil {
+		// an older set, whose runs must first be split out
+		err = b.writeMetadata(backend)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(b.runs) <= keep {
+		return 0, nil
+	}
+	old := b.runs[:len(b.runs)-keep]
+	b.runs = b.runs[len(b.runs)-keep:]
+	b.records = nil
+	b.encodedRecords = 0
+	// runs are being removed, not appended, so the index must be
+	// rewritten under a new nonce
+	b.encoded = nil
+	err = b.writeMetadata(backend)
+	if err != nil {
+		return 0, err
+	}
+	setId := tagToId(secrets, tag)
+	for _, run := range old {
+		err = backend.DeleteBackupSet(secrets.HexId(), runObjectId(setId, run.id))
+		if err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
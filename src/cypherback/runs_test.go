@@ -0,0 +1,157 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	memoryBackend "cypherback/backends/memory"
+	"fmt"
+	"testing"
+)
+
+// countRuns counts the run objects stored under SECRETSID in BACKEND
+func countRuns(t *testing.T, backend Backend, secretsId string) (runs int) {
+	ids, err := backend.ListBackupSets(secretsId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if isRunObject(id) {
+			runs++
+		}
+	}
+	return runs
+}
+
+func TestBackupSetRuns(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsId := secrets.HexId()
+	backend := memoryBackend.New()
+	for i := 0; i < 3; i++ {
+		set, err := EnsureBackupSet(backend, secrets, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(set.records) != 0 || len(set.runs) != i {
+			t.Fatal("Backup set has", len(set.records), "records loaded and", len(set.runs), "runs")
+		}
+		addRun(t, set, fmt.Sprintf("/tmp/run%d", i))
+		err = set.Write(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if countRuns(t, backend, secretsId) != 3 {
+		t.Error("Stored", countRuns(t, backend, secretsId), "runs")
+	}
+	setIds, err := listBackupSets(backend, secretsId)
+	if err != nil || len(setIds) != 1 {
+		t.Error("Listed backup sets", setIds, err)
+	}
+	latest, err := ReadBackupSetRuns(backend, secrets, "foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest.records) != 3 || latest.records[1].(symLinkInfo).name != "/tmp/run2" {
+		t.Error("Latest run is", latest.records)
+	}
+
+	pruned, err := PruneBackupSet(backend, secrets, "foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 || countRuns(t, backend, secretsId) != 1 {
+		t.Error("Pruned", pruned, "runs, leaving", countRuns(t, backend, secretsId))
+	}
+	set, err := ReadBackupSet(backend, secrets, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.records) != 3 || set.records[1].(symLinkInfo).name != "/tmp/run2" {
+		t.Error("Pruned backup set is", set.records)
+	}
+
+	// a run object swapped for another is caught
+	setId := tagToId(secrets, "foo")
+	other, err := EnsureBackupSet(backend, secrets, "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRun(t, other, "/tmp/other")
+	err = other.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherData, err := backend.ReadBackupSet(secretsId, runObjectId(tagToId(secrets, "bar"), other.runs[0].id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.WriteBackupSet(secretsId, runObjectId(setId, set.runs[0].id), otherData)
+	_, err = ReadBackupSet(backend, secrets, "foo")
+	if err == nil {
+		t.Error("Read a backup set with a swapped run")
+	}
+}
+
+func TestConvertBackupSet(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsId := secrets.HexId()
+	backend := memoryBackend.New()
+	set, err := newBackupSet("foo", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRun(t, set, "/tmp/first")
+	addRun(t, set, "/tmp/second")
+	data, err := set.encodeVersion(segmentedVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.WriteBackupSet(secretsId, tagToId(secrets, "foo"), data)
+
+	// older sets are loaded whole, and split into runs when written
+	set, err = EnsureBackupSet(backend, secrets, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.records) != 6 {
+		t.Error("Older backup set has", len(set.records), "records")
+	}
+	addRun(t, set, "/tmp/third")
+	err = set.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countRuns(t, backend, secretsId) != 3 {
+		t.Error("Converted backup set has", countRuns(t, backend, secretsId), "runs")
+	}
+	set, err = ReadBackupSet(backend, secrets, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.records) != 9 || len(set.runs) != 3 {
+		t.Error("Converted backup set has", len(set.records), "records in", len(set.runs), "runs")
+	}
+}
@@ -20,7 +20,6 @@ package cypherback
 import (
 	"bitbucket.org/taruti/termios"
 	"bytes"
-	"code.google.com/p/go.crypto/pbkdf2"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
@@ -30,101 +29,209 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	"math/big"
-	//"time"
+	"log"
+	"strings"
+	"time"
 )
 
 type Secrets struct {
+	// plaintext label, to help humans tell secrets files apart
+	label string
+	// the generation of the secrets file last read or written; see
+	// generations.go
+	generation uint64
 	// AES-256 keys
-	metadataMaster  []byte
-	chunkMaster     []byte
-	metadataStorage []byte
+	metadataMaster  keyBuffer
+	chunkMaster     keyBuffer
+	metadataStorage keyBuffer
 	// HMAC-SHA-384 keys
-	metadataAuthentication []byte
-	chunkAuthentication    []byte
-	chunkStorage           []byte
-	// all the above are []byte rather than [32]byte, [48]byte or
+	metadataAuthentication keyBuffer
+	chunkAuthentication    keyBuffer
+	chunkStorage           keyBuffer
+	// all the above are slices rather than [32]byte, [48]byte or
 	// [8]byte in order to eliminate unnecessary copying, which
 	// could lead to unzeroed keys in RAM
 }
 
-func genKey(length int) (key []byte, err error) {
-	key = make([]byte, length)
+// genKey generates a random key of LENGTH bytes in locked memory
+func genKey(length int) (key keyBuffer, err error) {
+	key = newKeyBuffer(length)
 	n, err := io.ReadFull(rand.Reader, key)
 	if err != nil {
+		key.wipe()
 		return nil, err
 	}
 	if n != length {
-		return nil, fmt.Errorf("Couldn't read enough random bytes (wanted %d; got %d)", length)
+		key.wipe()
+		return nil, fmt.Errorf("Couldn't read enough random bytes (wanted %d; got %d)", length, n)
 	}
 	return key, nil
 }
 
+// genNonce generates LENGTH random bytes which need not be kept
+// secret, such as salts and nonces
+func genNonce(length int) (nonce []byte, err error) {
+	nonce = make([]byte, length)
+	n, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if n != length {
+		return nil, fmt.Errorf("Couldn't read enough random bytes (wanted %d; got %d)", length, n)
+	}
+	return nonce, nil
+}
+
+// readPassphrase prompts for a passphrase and returns it in locked
+// memory.  termios returns it as a string, which cannot be wiped, so
+// it is copied at once and the string dropped.
+func readPassphrase(prompt string) keyBuffer {
+	passphrase := termios.Password(prompt)
+	buf := newKeyBuffer(len(passphrase))
+	copy(buf, passphrase)
+	return buf
+}
+
+// readNewPassphrase is like readPassphrase, but has the passphrase
+// typed twice
+func readNewPassphrase() keyBuffer {
+	passphrase := termios.PasswordConfirm("Enter passphrase: ", "Repeat passphrase: ")
+	buf := newKeyBuffer(len(passphrase))
+	copy(buf, passphrase)
+	return buf
+}
+
 func generateSecrets() (secrets *Secrets, err error) {
 	secrets = &Secrets{}
 	secrets.metadataMaster, err = genKey(32)
 	if err != nil {
+		ZeroSecrets(secrets)
 		return nil, err
 	}
 	secrets.chunkMaster, err = genKey(32)
 	if err != nil {
+		ZeroSecrets(secrets)
 		return nil, err
 	}
 	secrets.metadataAuthentication, err = genKey(48)
 	if err != nil {
+		ZeroSecrets(secrets)
 		return nil, err
 	}
 	secrets.chunkAuthentication, err = genKey(48)
 	if err != nil {
+		ZeroSecrets(secrets)
 		return nil, err
 	}
 	secrets.metadataStorage, err = genKey(48)
 	if err != nil {
+		ZeroSecrets(secrets)
 		return nil, err
 	}
 	secrets.chunkStorage, err = genKey(48)
 	if err != nil {
+		ZeroSecrets(secrets)
 		return nil, err
 	}
 	return secrets, nil
 }
 
-func GenerateSecrets(backend Backend) (secrets *Secrets, err error) {
+// GenerateSecrets generates a new set of keys and writes them to
+// BACKEND, encrypted under a passphrase with KDF.  LABEL is stored
+// in plaintext alongside, so that humans can tell secrets files apart.
+func GenerateSecrets(backend Backend, kdf KDF, label string) (secrets *Secrets, err error) {
 	secrets, err = generateSecrets()
 	if err != nil {
 		return nil, err
 	}
-	err = writeSecrets(secrets, backend)
+	secrets.label = label
+	err = writeSecrets(secrets, backend, kdf)
 	if err != nil {
+		ZeroSecrets(secrets)
 		return nil, err
 	}
 
 	return secrets, nil
 }
 
-func writeSecrets(secrets *Secrets, backend Backend) (err error) {
+// RewrapSecrets re-encrypts SECRETS under a new passphrase using KDF,
+// replacing the stored secrets file.  The keys themselves, and hence
+// the secrets ID, do not change.
+func RewrapSecrets(backend Backend, secrets *Secrets, kdf KDF) error {
+	return writeSecrets(secrets, backend, kdf)
+}
+
+func writeSecrets(secrets *Secrets, backend Backend, kdf KDF) (err error) {
+	passphrase := readNewPassphrase()
+	defer passphrase.wipe()
+	secrets.generation = generationCache.next(secrets.HexId(), secretsFileId, secrets.generation)
+	encSecrets, err := encodeSecrets(secrets, passphrase, kdf)
+	if err != nil {
+		return err
+	}
+	err = backend.WriteSecrets(secrets.HexId(), encSecrets)
+	if err != nil {
+		return err
+	}
+	return generationCache.check(secrets.HexId(), secretsFileId, secrets.generation)
+}
+
+// keyFields returns pointers to each key in the order in which they
+// are stored in a secrets file.
+func (s *Secrets) keyFields() []*keyBuffer {
+	return []*keyBuffer{&s.metadataMaster,
+		&s.metadataAuthentication,
+		&s.metadataStorage,
+		&s.chunkMaster,
+		&s.chunkAuthentication,
+		&s.chunkStorage}
+}
+
+// lengths of the keys returned by keyFields
+var secretsKeyLengths = []int{32, 48, 48, 32, 48, 48}
+
+// secretsKeysLength returns the total length of the keys
+func secretsKeysLength() (length int) {
+	for _, keyLength := range secretsKeyLengths {
+		length += keyLength
+	}
+	return length
+}
+
+// the secrets file version written; versions up to 2 encrypt the keys
+// with AES-256-CTR, version 3 with AES-256-GCM, and version 4 also
+// holds a generation after the label
+const secretsVersion = 4
+
+func encodeSecrets(secrets *Secrets, passphrase []byte, kdf KDF) ([]byte, error) {
+	return encodeSecretsVersion(secrets, passphrase, kdf, secretsVersion)
+}
+
+// encodeSecretsVersion writes a secrets file of VERSION, which must
+// be 2, 3 or 4
+func encodeSecretsVersion(secrets *Secrets, passphrase []byte, kdf KDF, version uint8) ([]byte, error) {
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("Cannot write secrets file version %d", version)
+	}
 	/*
 		To write a secrets file:
 
-		PBKDF2 the user's password with a random 32-byte salt
-		under SHA-384; use this to generate 80 bytes of keying
+		Run the user's password with a random 32-byte salt
+		through the KDF to generate 80 bytes of keying
 		material.  The first 32 bytes form an AES-256
 		encryption key; the next 48 bytes form an HMAC-SHA-384
 		authentication key.
 
 	*/
-
-	passphrase := termios.PasswordConfirm("Enter passphrase: ", "Repeat passphrase: ")
-	salt := make([]byte, 32)
-	n, err := rand.Reader.Read(salt)
+	salt, err := genNonce(32)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if n != 32 {
-		return fmt.Errorf("Could not read enough random bytes for salt")
+	secretsKeys, err := kdf.deriveKeys(passphrase, salt, 80)
+	if err != nil {
+		return nil, err
 	}
-	iterations := 131072 // magic number, about 1 second's worth of time on my lappop
-	secretsKeys := pbkdf2.Key([]byte(passphrase), salt, iterations, 80, sha512.New384)
+	defer secretsKeys.wipe()
 	secretsEncKey := secretsKeys[:32]
 	secretsAuthKey := secretsKeys[32:]
 	secretsKeysDigest := sha512.New384()
@@ -133,283 +240,352 @@ func writeSecrets(secrets *Secrets, backend Backend) (err error) {
 	authHMAC := hmac.New(sha512.New384, secretsAuthKey)
 	file := bytes.NewBuffer(nil)
 	writer := io.MultiWriter(file, authHMAC)
-	version := []byte{0}
-	n, err = writer.Write(version)
-	if err != nil {
-		return err
-	}
-	if n != 1 {
-		return fmt.Errorf("Error writing secrets file")
-	}
 
-	n, err = writer.Write(salt)
+	iv, err := genNonce(16)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if n != len(salt) {
-		return fmt.Errorf("Error writing secrets file")
+	header := &bytes.Buffer{}
+	header.Write([]byte{version, kdf.id()})
+	header.Write(salt)
+	header.Write(kdf.params())
+	binary.Write(header, binary.BigEndian, uint32(len(secrets.label)))
+	header.Write([]byte(secrets.label))
+	if version >= 4 {
+		binary.Write(header, binary.BigEndian, secrets.generation)
 	}
-
-	iterBig := big.NewInt(int64(iterations))
-	iterBytes := iterBig.Bytes()
-	iterBytes = append(make([]byte, 8-len(iterBytes)), iterBytes...)
-	n, err = writer.Write(iterBytes)
+	header.Write(secretsKeysHash)
+	header.Write(iv)
+	n, err := writer.Write(header.Bytes())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if n != len(iterBytes) {
-		return fmt.Errorf("Error writing secrets file")
+	if n != header.Len() {
+		return nil, fmt.Errorf("Error writing secrets file")
 	}
 
-	n, err = writer.Write(secretsKeysHash)
-	if err != nil {
-		return err
-	}
-	if n != len(secretsKeysHash) {
-		return fmt.Errorf("Error writing secrets file")
+	keys := newKeyBuffer(secretsKeysLength())
+	defer keys.wipe()
+	offset := 0
+	for i, key := range secrets.keyFields() {
+		if len(*key) != secretsKeyLengths[i] {
+			return nil, fmt.Errorf("Error writing secrets file: key %d is %d bytes, not %d", i, len(*key), secretsKeyLengths[i])
+		}
+		offset += copy(keys[offset:], *key)
 	}
-
-	iv, err := genKey(16)
+	cypher, err := aes.NewCipher(secretsEncKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	n, err = writer.Write(iv)
+	var encKeys []byte
+	if version == 2 {
+		encKeys = make([]byte, len(keys))
+		cipher.NewCTR(cypher, iv).XORKeyStream(encKeys, keys)
+	} else {
+		aead, err := cipher.NewGCM(cypher)
+		if err != nil {
+			return nil, err
+		}
+		// the header is authenticated too
+		encKeys = aead.Seal(nil, iv[:aead.NonceSize()], keys, header.Bytes())
+	}
+	n, err = writer.Write(encKeys)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if n != len(iv) {
-		return fmt.Errorf("Error writing secrets file")
+	if n != len(encKeys) {
+		return nil, fmt.Errorf("Error writing secrets file")
 	}
 
-	cypher, err := aes.NewCipher(secretsEncKey)
+	authSum := authHMAC.Sum(nil)
+	n, err = writer.Write(authSum)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if n != len(authSum) {
+		return nil, fmt.Errorf("Error writing secrets file")
+	}
+	return file.Bytes(), nil
+}
 
-	ctrWriter := cipher.StreamWriter{S: cipher.NewCTR(cypher, iv),
-		W: writer}
+// ReadSecrets prompts for a passphrase and uses it to decrypt the
+// secrets file ID stored in BACKEND, or the default secrets file if ID
+// is empty.  It also reports how the file was unlocked, so that the
+// caller can suggest re-tuning it; the file is never rewritten.
+func ReadSecrets(backend Backend, id string) (secrets *Secrets, unlock *SecretsUnlock, err error) {
+	passphrase := readPassphrase("Enter passphrase: ")
+	defer passphrase.wipe()
 
-	n, err = ctrWriter.Write(secrets.metadataMaster)
-	if err != nil {
-		return err
-	}
-	if n != len(secrets.metadataMaster) {
-		return fmt.Errorf("Error writing secrets file")
+	var encSecrets []byte
+	if id == "" {
+		encSecrets, err = backend.ReadSecrets()
+	} else {
+		encSecrets, err = backend.ReadSecretsById(id)
 	}
-
-	n, err = ctrWriter.Write(secrets.metadataAuthentication)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if n != len(secrets.metadataAuthentication) {
-		return fmt.Errorf("Error writing secrets file")
-	}
-
-	n, err = ctrWriter.Write(secrets.metadataStorage)
+	header, err := readSecretsHeader(encSecrets)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if n != len(secrets.metadataStorage) {
-		return fmt.Errorf("Error writing secrets file")
-	}
-
-	n, err = ctrWriter.Write(secrets.chunkMaster)
+	start := time.Now()
+	secrets, kdf, err := decodeSecrets(encSecrets, passphrase)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if n != len(secrets.chunkMaster) {
-		return fmt.Errorf("Error writing secrets file")
+	if id != "" && secrets.HexId() != id {
+		ZeroSecrets(secrets)
+		return nil, nil, fmt.Errorf("Secrets file %s contains secrets %s", id, secrets.HexId())
 	}
-
-	n, err = ctrWriter.Write(secrets.chunkAuthentication)
+	err = generationCache.check(secrets.HexId(), secretsFileId, secrets.generation)
 	if err != nil {
-		return err
-	}
-	if n != len(secrets.chunkAuthentication) {
-		return fmt.Errorf("Error writing secrets file")
+		ZeroSecrets(secrets)
+		return nil, nil, err
 	}
+	unlock = &SecretsUnlock{KDF: kdf, Elapsed: time.Since(start), Outdated: header.version < secretsVersion}
+	return secrets, unlock, nil
+}
 
-	n, err = ctrWriter.Write(secrets.chunkStorage)
-	if err != nil {
-		return err
-	}
-	if n != len(secrets.chunkStorage) {
-		return fmt.Errorf("Error writing secrets file")
-	}
+// A SecretsUnlock describes how a secrets file was unlocked
+type SecretsUnlock struct {
+	// KDF protects the file
+	KDF KDF
+	// Elapsed is how long unlocking it took
+	Elapsed time.Duration
+	// Outdated is true if the file is of an older version than is
+	// written now
+	Outdated bool
+}
 
-	authSum := authHMAC.Sum(nil)
-	n, err = writer.Write(authSum)
-	if err != nil {
-		return err
-	}
-	if n != len(authSum) {
-		return fmt.Errorf("Error writing secrets file")
+// NeedsRetune reports whether the secrets file should be rewritten
+// under a re-tuned KDF: because it is outdated, or because unlocking
+// it took under half or over twice the target time.  A slow machine
+// is no reason to weaken the file for everyone, so it is for the user
+// to decide.
+func (u *SecretsUnlock) NeedsRetune() bool {
+	return u.Outdated || u.Elapsed < kdfTarget/2 || u.Elapsed > 2*kdfTarget
+}
+
+// Suggested returns a KDF of the same type whose cost would make
+// unlocking take about the target time on this machine
+func (u *SecretsUnlock) Suggested() KDF {
+	if u.Elapsed <= 0 {
+		return u.KDF
 	}
-	return backend.WriteSecrets(hex.EncodeToString(secrets.Id()), file.Bytes())
+	return u.KDF.scale(float64(kdfTarget) / float64(u.Elapsed))
 }
 
-func ReadSecrets(backend Backend) (secrets *Secrets, err error) {
-	passphrase := termios.Password("Enter passphrase: ")
+// the plaintext portion of a secrets file, preceding the encrypted keys
+type secretsHeader struct {
+	version    uint8
+	kdf        KDF
+	salt       []byte
+	label      string
+	generation uint64
+	keysHash   []byte
+	iv         []byte
+	length     int
+}
 
-	encSecrets, err := backend.ReadSecrets()
+// readSecretsHeader parses the plaintext header of ENCSECRETS.  The
+// header is not authenticated until the keys have been derived.
+func readSecretsHeader(encSecrets []byte) (h *secretsHeader, err error) {
+	file := bytes.NewReader(encSecrets)
+	h = &secretsHeader{}
+	err = binary.Read(file, binary.BigEndian, &h.version)
 	if err != nil {
 		return nil, err
 	}
-	file := bytes.NewBuffer(encSecrets)
-	version := make([]byte, 1)
-	n, err := file.Read(version)
+	h.salt = make([]byte, 32)
+	switch h.version {
+	case 0:
+		// version 0 always uses PBKDF2, and stores the salt
+		// before the iteration count
+		_, err = io.ReadFull(file, h.salt)
+		if err != nil {
+			return nil, err
+		}
+		h.kdf, err = readPBKDF2Params(file)
+	case 1, 2, 3, 4:
+		var kdfId uint8
+		err = binary.Read(file, binary.BigEndian, &kdfId)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(file, h.salt)
+		if err != nil {
+			return nil, err
+		}
+		h.kdf, err = readKDF(kdfId, file)
+	default:
+		return nil, fmt.Errorf("Cannot read file version %d", h.version)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if n != 1 {
-		return nil, fmt.Errorf("Error reading secrets file")
-	}
-	if version[0] != 0 {
-		return nil, fmt.Errorf("Cannot read file version %d", version[0])
-	}
-
-	salt := make([]byte, 32)
-	n, err = file.Read(salt)
+	if h.version >= 2 {
+		var labelLen uint32
+		err = binary.Read(file, binary.BigEndian, &labelLen)
+		if err != nil {
+			return nil, err
+		}
+		if int64(labelLen) > int64(file.Len()) {
+			return nil, fmt.Errorf("Error reading secrets file: label length %d", labelLen)
+		}
+		h.label, err = readLenString(file, labelLen)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if h.version >= 4 {
+		err = binary.Read(file, binary.BigEndian, &h.generation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.keysHash = make([]byte, sha512.Size384)
+	_, err = io.ReadFull(file, h.keysHash)
 	if err != nil {
 		return nil, err
 	}
-	if n != len(salt) {
-		return nil, fmt.Errorf("Error reading secrets file")
-	}
-
-	iterBytes := make([]byte, 8)
-	n, err = file.Read(iterBytes)
+	h.iv = make([]byte, 16)
+	_, err = io.ReadFull(file, h.iv)
 	if err != nil {
 		return nil, err
 	}
-	if n != len(iterBytes) {
-		return nil, fmt.Errorf("Error reading secrets file")
-	}
-	iterBig := big.NewInt(0)
-	iterBig.SetBytes(iterBytes)
-	iterations := int(iterBig.Int64())
+	h.length = len(encSecrets) - file.Len()
+	return h, nil
+}
 
-	// FIXME: add some code to the iterations and rewrite the file
-	// if the time to generate a key is too far from the target of 1
-	// second
-	secretsKeys := pbkdf2.Key([]byte(passphrase), salt, iterations, 80, sha512.New384)
-	secretsDigest := sha512.New384()
-	// don't need to check for errors, per spec
-	secretsDigest.Write(secretsKeys)
-	secretsKeysHash := secretsDigest.Sum(nil)
-	storedHash := make([]byte, len(secretsKeysHash))
-	n, err = file.Read(storedHash)
+// decodeSecrets decrypts and authenticates ENCSECRETS, returning the
+// keys and the KDF with which they were protected.
+func decodeSecrets(encSecrets, passphrase []byte) (secrets *Secrets, kdf KDF, err error) {
+	header, err := readSecretsHeader(encSecrets)
 	if err != nil {
-		return nil, err
-	}
-	if n != len(storedHash) {
-		return nil, fmt.Errorf("Error reading secrets file")
+		return nil, nil, err
 	}
-	if !bytes.Equal(storedHash, secretsKeysHash) {
-		return nil, fmt.Errorf("Bad password")
-	}
-
-	iv := make([]byte, 16)
-	n, err = file.Read(iv)
+	secretsKeys, err := header.kdf.deriveKeys(passphrase, header.salt, 80)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if n != len(iv) {
-		return nil, fmt.Errorf("Error reading secrets file")
+	defer secretsKeys.wipe()
+	secretsDigest := sha512.New384()
+	// don't need to check for errors, per spec
+	secretsDigest.Write(secretsKeys)
+	if !bytes.Equal(header.keysHash, secretsDigest.Sum(nil)) {
+		return nil, nil, fmt.Errorf("Bad password")
 	}
 
 	secretsEncKey := secretsKeys[:32]
 	secretsAuthKey := secretsKeys[32:]
-	authHMAC := hmac.New(sha512.New384, secretsAuthKey)
-	authHMAC.Write(version)
-	authHMAC.Write(salt)
-	authHMAC.Write(iterBytes)
-	authHMAC.Write(secretsKeysHash)
-	authHMAC.Write(iv)
-
-	reader := io.TeeReader(file, authHMAC)
 	cypher, err := aes.NewCipher(secretsEncKey)
 	if err != nil {
-		return nil, err
-	}
-	ctrReader := cipher.StreamReader{S: cipher.NewCTR(cypher, iv),
-		R: reader}
-
-	secrets = &Secrets{}
-	secrets.metadataMaster = make([]byte, 32)
-	n, err = ctrReader.Read(secrets.metadataMaster)
-	if err != nil {
-		ZeroSecrets(secrets)
-		return nil, err
-	}
-	if n != len(secrets.metadataMaster) {
-		ZeroSecrets(secrets)
-		return nil, fmt.Errorf("Error reading secrets file")
-	}
-	secrets.metadataAuthentication = make([]byte, 48)
-	n, err = ctrReader.Read(secrets.metadataAuthentication)
-	if err != nil {
-		ZeroSecrets(secrets)
-		return nil, err
-	}
-	if n != len(secrets.metadataAuthentication) {
-		ZeroSecrets(secrets)
-		return nil, fmt.Errorf("Error reading secrets file")
-	}
-	secrets.metadataStorage = make([]byte, 48)
-	n, err = ctrReader.Read(secrets.metadataStorage)
-	if err != nil {
-		ZeroSecrets(secrets)
-		return nil, err
-	}
-	if n != len(secrets.metadataStorage) {
-		ZeroSecrets(secrets)
-		return nil, fmt.Errorf("Error reading secrets file")
-	}
-	secrets.chunkMaster = make([]byte, 32)
-	n, err = ctrReader.Read(secrets.chunkMaster)
-	if err != nil {
-		ZeroSecrets(secrets)
-		return nil, err
+		return nil, nil, err
 	}
-	if n != len(secrets.chunkMaster) {
-		ZeroSecrets(secrets)
-		return nil, fmt.Errorf("Error reading secrets file")
-	}
-	secrets.chunkAuthentication = make([]byte, 48)
-	n, err = ctrReader.Read(secrets.chunkAuthentication)
-	if err != nil {
-		ZeroSecrets(secrets)
-		return nil, err
+	var aead cipher.AEAD
+	encKeysLength := secretsKeysLength()
+	if header.version >= 3 {
+		aead, err = cipher.NewGCM(cypher)
+		if err != nil {
+			return nil, nil, err
+		}
+		encKeysLength += aead.Overhead()
 	}
-	if n != len(secrets.chunkAuthentication) {
-		ZeroSecrets(secrets)
-		return nil, fmt.Errorf("Error reading secrets file")
+	if len(encSecrets) != header.length+encKeysLength+sha512.Size384 {
+		return nil, nil, fmt.Errorf("Error reading secrets file: %d bytes of keys", len(encSecrets)-header.length)
 	}
-	secrets.chunkStorage = make([]byte, 48)
-	n, err = ctrReader.Read(secrets.chunkStorage)
+	authLength := len(encSecrets) - sha512.Size384
+
+	authHMAC := hmac.New(sha512.New384, secretsAuthKey)
+	authHMAC.Write(encSecrets[:authLength])
+	if !hmac.Equal(authHMAC.Sum(nil), encSecrets[authLength:]) {
+		return nil, nil, fmt.Errorf("Corrupted secrets file")
+	}
+
+	var keysReader io.Reader
+	if aead != nil {
+		keys := newKeyBuffer(secretsKeysLength())
+		defer keys.wipe()
+		// opening into KEYS, which has room, doesn't reallocate
+		_, err = aead.Open(keys[:0], header.iv[:aead.NonceSize()], encSecrets[header.length:authLength], encSecrets[:header.length])
+		if err != nil {
+			return nil, nil, fmt.Errorf("Corrupted secrets file")
+		}
+		keysReader = bytes.NewReader(keys)
+	} else {
+		keysReader = cipher.StreamReader{S: cipher.NewCTR(cypher, header.iv),
+			R: bytes.NewReader(encSecrets[header.length:authLength])}
+	}
+
+	secrets = &Secrets{label: header.label, generation: header.generation}
+	for i, key := range secrets.keyFields() {
+		*key = newKeyBuffer(secretsKeyLengths[i])
+		_, err = io.ReadFull(keysReader, *key)
+		if err != nil {
+			ZeroSecrets(secrets)
+			return nil, nil, err
+		}
+	}
+	return secrets, header.kdf, nil
+}
+
+// SecretsInfo describes a secrets file without decrypting it.
+type SecretsInfo struct {
+	Id      string
+	Label   string
+	KDF     string
+	Default bool
+}
+
+// ListSecrets describes every secrets file stored in BACKEND.
+func ListSecrets(backend Backend) (infos []SecretsInfo, err error) {
+	ids, err := backend.ListSecrets()
 	if err != nil {
-		ZeroSecrets(secrets)
 		return nil, err
 	}
-	if n != len(secrets.chunkStorage) {
-		ZeroSecrets(secrets)
-		return nil, fmt.Errorf("Error reading secrets file")
-	}
+	// there may legitimately be no default yet
+	defaultId, _ := backend.DefaultSecretsId()
+	for _, id := range ids {
+		encSecrets, err := backend.ReadSecretsById(id)
+		if err != nil {
+			return nil, err
+		}
+		header, err := readSecretsHeader(encSecrets)
+		if err != nil {
+			return nil, fmt.Errorf("Secrets file %s: %v", id, err)
+		}
+		infos = append(infos, SecretsInfo{Id: id,
+			Label:   header.label,
+			KDF:     header.kdf.String(),
+			Default: id == defaultId})
+	}
+	return infos, nil
+}
 
-	calcSum := authHMAC.Sum(nil)
-	authSum := make([]byte, authHMAC.Size())
-	n, err = reader.Read(authSum)
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
-	if n != len(authSum) {
-		return nil, fmt.Errorf("Error reading secrets file: %d", n)
-	}
-	if !bytes.Equal(calcSum, authSum) {
-		return nil, fmt.Errorf("Corrupted secrets file")
-	}
-	return secrets, nil
+// ResolveSecretsId finds the single secrets file in BACKEND whose ID,
+// ID prefix or label is NAME.
+func ResolveSecretsId(backend Backend, name string) (id string, err error) {
+	infos, err := ListSecrets(backend)
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, info := range infos {
+		if info.Id == name {
+			return info.Id, nil
+		}
+		if strings.HasPrefix(info.Id, name) || info.Label == name {
+			matches = append(matches, info.Id)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("No secrets file matches %s", name)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("%d secrets files match %s", len(matches), name)
 }
 
 // ZeroSecrets zeros out all non-nil keys in SECRETS.
@@ -431,7 +607,7 @@ func ZeroSecrets(secrets *Secrets) {
 		secrets.metadataAuthentication = nil
 	}
 	if secrets.metadataStorage != nil {
-		zeroKey(secrets.metadataStorage, 48, "metadata authentication key")
+		zeroKey(secrets.metadataStorage, 48, "metadata storage key")
 		secrets.metadataStorage = nil
 	}
 	if secrets.chunkAuthentication != nil {
@@ -439,24 +615,20 @@ func ZeroSecrets(secrets *Secrets) {
 		secrets.chunkAuthentication = nil
 	}
 	if secrets.chunkStorage != nil {
-		zeroKey(secrets.chunkStorage, 48, "chunk storage")
+		zeroKey(secrets.chunkStorage, 48, "chunk storage key")
 		secrets.chunkStorage = nil
 	}
 	return
 }
 
-// zero out a byte array which should be LENGTH bytes long; if it's not
-// then panic with an error
-func zeroKey(key []byte, length int, description string) {
+// zero out a key which should be LENGTH bytes long; if it's not then
+// log an error, but zero it all the same, so that zeroing of the
+// remaining keys always completes
+func zeroKey(key keyBuffer, length int, description string) {
 	if len(key) != length {
-		// FIXME: is panicing the right thing to do here?  It
-		// prevents further zeroing.  Perhaps it should be
-		// logged, to allow completiong of zeroing.
-		panic(fmt.Errorf("SERIOUS ERROR: %s is %d bytes, not %d bytes.  Destroy all items encrypted under this scheme.", description, len(key), length))
-	}
-	for i := 0; i < length; i++ {
-		key[i] = 0
+		log.Printf("SERIOUS ERROR: %s is %d bytes, not %d bytes.  Destroy all items encrypted under this scheme.", description, len(key), length)
 	}
+	key.wipe()
 }
 
 func (secrets *Secrets) Id() []byte {
@@ -472,13 +644,26 @@ func (secrets *Secrets) Id() []byte {
 	return digester.Sum(nil)
 }
 
+// Label returns the plaintext label of the secrets file.
+func (s *Secrets) Label() string {
+	return s.label
+}
+
+// SetLabel sets the plaintext label used when the secrets file is
+// next written.
+func (s *Secrets) SetLabel(label string) {
+	s.label = label
+}
+
 func (s *Secrets) HexId() string {
 	return hex.EncodeToString(s.Id())
 }
 
-func nistConcatKDF(keyDerivationKey, label, context []byte, bytes int) []byte {
+// nistConcatKDF derives BYTES bytes of keying material, which the
+// caller must wipe
+func nistConcatKDF(keyDerivationKey, label, context []byte, bytes int) keyBuffer {
 	iterations := (bytes + 48 - 1) / 48 // (x + y -1)/y == ceiling(x, y)
-	keyMat := make([]byte, 0, bytes)
+	keyMat := newKeyBuffer(bytes)
 	for i := 0; i < iterations; i++ {
 		digester := hmac.New(sha512.New384, keyDerivationKey)
 		binary.Write(digester, binary.BigEndian, int64(i))
@@ -486,7 +671,9 @@ func nistConcatKDF(keyDerivationKey, label, context []byte, bytes int) []byte {
 		digester.Write([]byte{0})
 		digester.Write(context)
 		binary.Write(digester, binary.BigEndian, int64(bytes*8))
-		keyMat = append(keyMat, digester.Sum(nil)...)
+		sum := digester.Sum(nil)
+		copy(keyMat[i*48:], sum)
+		zeroBytes(sum)
 	}
 	return keyMat
 }
@@ -18,15 +18,157 @@
 package cypherback
 
 import (
+	"bytes"
+	"crypto/sha512"
 	memoryBackend "cypherback/backends/memory"
 	"testing"
 )
 
 func TestGenerateSecrets(t *testing.T) {
 	backend := memoryBackend.New()
-	secrets, err := GenerateSecrets(backend)
+	secrets, err := GenerateSecrets(backend, DefaultKDF(), "")
 	defer ZeroSecrets(secrets)
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+func TestEncodeDecodeSecrets(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdfs := []KDF{pbkdf2KDF{iterations: 1024}, scryptKDF{n: 1024, r: 8, p: 1}}
+	for _, kdf := range kdfs {
+		encSecrets, err := encodeSecrets(secrets, []byte("passphrase"), kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, decodedKDF, err := decodeSecrets(encSecrets, []byte("passphrase"))
+		if err != nil {
+			t.Fatal(kdf, err)
+		}
+		if !bytes.Equal(decoded.Id(), secrets.Id()) {
+			t.Error("Decoded secrets do not match", kdf)
+		}
+		if decodedKDF != kdf {
+			t.Error("Decoded KDF", decodedKDF, "does not match", kdf)
+		}
+		ZeroSecrets(decoded)
+		_, _, err = decodeSecrets(encSecrets, []byte("wrong passphrase"))
+		if err == nil {
+			t.Error("Decoded secrets with the wrong passphrase", kdf)
+		}
+	}
+}
+
+func TestSecretsVersions(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdf := pbkdf2KDF{iterations: 1024}
+	secrets.generation = 7
+	for _, version := range []uint8{2, 3, 4} {
+		encSecrets, err := encodeSecretsVersion(secrets, []byte("passphrase"), kdf, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encSecrets[0] != version {
+			t.Error("Wrote version", encSecrets[0], "not", version)
+		}
+		decoded, _, err := decodeSecrets(encSecrets, []byte("passphrase"))
+		if err != nil {
+			t.Fatal(version, err)
+		}
+		if !bytes.Equal(decoded.Id(), secrets.Id()) {
+			t.Error("Decoded secrets do not match", version)
+		}
+		if (version >= 4) != (decoded.generation == secrets.generation) {
+			t.Error("Decoded generation", decoded.generation, "from version", version)
+		}
+		ZeroSecrets(decoded)
+		encSecrets[len(encSecrets)-sha512.Size384-1] ^= 1
+		_, _, err = decodeSecrets(encSecrets, []byte("passphrase"))
+		if err == nil {
+			t.Error("Decoded corrupted secrets", version)
+		}
+	}
+}
+
+func TestListSecrets(t *testing.T) {
+	backend := memoryBackend.New()
+	kdf := pbkdf2KDF{iterations: 1024}
+	var ids []string
+	for _, label := range []string{"laptop", "server"} {
+		secrets, err := generateSecrets()
+		defer ZeroSecrets(secrets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secrets.label = label
+		encSecrets, err := encodeSecrets(secrets, []byte("passphrase"), kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = backend.WriteSecrets(secrets.HexId(), encSecrets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, secrets.HexId())
+	}
+	infos, err := ListSecrets(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatal("Expected 2 secrets files, got", len(infos))
+	}
+	for _, info := range infos {
+		if info.Default != (info.Id == ids[0]) {
+			t.Error("Wrong default", info)
+		}
+	}
+	id, err := ResolveSecretsId(backend, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != ids[1] {
+		t.Error("Resolved label to", id, "not", ids[1])
+	}
+	encSecrets, err := backend.ReadSecretsById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, _, err := decodeSecrets(encSecrets, []byte("passphrase"))
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secrets.Label() != "server" {
+		t.Error("Bad label", secrets.Label())
+	}
+}
+
+func TestSecretsUnlock(t *testing.T) {
+	kdf := scryptKDF{n: 1 << 14, r: 8, p: 1}
+	for _, test := range []struct {
+		unlock SecretsUnlock
+		retune bool
+	}{
+		{SecretsUnlock{KDF: kdf, Elapsed: kdfTarget}, false},
+		{SecretsUnlock{KDF: kdf, Elapsed: kdfTarget / 4}, true},
+		{SecretsUnlock{KDF: kdf, Elapsed: 3 * kdfTarget}, true},
+		{SecretsUnlock{KDF: kdf, Elapsed: kdfTarget, Outdated: true}, true},
+	} {
+		if test.unlock.NeedsRetune() != test.retune {
+			t.Error(test.unlock, "needs re-tuning:", !test.retune)
+		}
+	}
+	unlock := SecretsUnlock{KDF: kdf, Elapsed: kdfTarget / 4}
+	if suggested := unlock.Suggested().(scryptKDF); suggested.n != 1<<16 {
+		t.Error("Suggested", suggested)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"log"
+	"sync"
+)
+
+// A keyBuffer holds key material: keys, derived keys and IVs, and
+// passphrases.  Where the platform allows it, a keyBuffer lives
+// outside the Go heap in memory which is locked against being swapped
+// out (see lockMemory), so that the garbage collector never copies it
+// and it never reaches the disk.  It must be wiped when done with, and
+// must not be used afterwards.
+//
+// Go's AES and HMAC implementations keep their own expanded copies of
+// keys on the heap; nothing can be done about those.
+type keyBuffer []byte
+
+// locked memory regions, indexed by the first byte of the keyBuffer
+// which each holds
+var lockedRegions = struct {
+	sync.Mutex
+	regions map[*byte][]byte
+}{regions: make(map[*byte][]byte)}
+
+var lockFailure sync.Once
+
+// newKeyBuffer allocates a zeroed keyBuffer of LENGTH bytes.  If
+// memory cannot be locked the buffer comes from the heap, with a
+// warning the first time.
+func newKeyBuffer(length int) keyBuffer {
+	if length == 0 {
+		return keyBuffer{}
+	}
+	region, err := lockMemory(length)
+	if err != nil {
+		lockFailure.Do(func() {
+			log.Printf("Could not lock memory for keys (%v); they may be swapped to disk", err)
+		})
+		return make(keyBuffer, length)
+	}
+	buf := keyBuffer(region[:length:length])
+	lockedRegions.Lock()
+	lockedRegions.regions[&buf[0]] = region
+	lockedRegions.Unlock()
+	return buf
+}
+
+// lockKey returns a keyBuffer holding a copy of B, which is zeroed.
+// It is for key material which a library has returned on the heap.
+func lockKey(b []byte) keyBuffer {
+	buf := newKeyBuffer(len(b))
+	copy(buf, b)
+	zeroBytes(b)
+	return buf
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// wipe zeroes K and releases its memory.
+func (k keyBuffer) wipe() {
+	if len(k) == 0 {
+		return
+	}
+	zeroBytes(k)
+	lockedRegions.Lock()
+	region, ok := lockedRegions.regions[&k[0]]
+	delete(lockedRegions.regions, &k[0])
+	lockedRegions.Unlock()
+	if ok {
+		unlockMemory(region)
+	}
+}
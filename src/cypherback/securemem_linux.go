@@ -0,0 +1,47 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockMemory maps whole pages of anonymous memory, at least LENGTH
+// bytes of them, and locks them into RAM.
+func lockMemory(length int) ([]byte, error) {
+	pageSize := os.Getpagesize()
+	size := (length + pageSize - 1) / pageSize * pageSize
+	region, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Mlock(region)
+	if err != nil {
+		syscall.Munmap(region)
+		return nil, err
+	}
+	return region, nil
+}
+
+// unlockMemory releases REGION, which was returned by lockMemory and
+// has already been zeroed.
+func unlockMemory(region []byte) {
+	syscall.Munlock(region)
+	syscall.Munmap(region)
+}
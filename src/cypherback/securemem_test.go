@@ -0,0 +1,55 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"testing"
+)
+
+func TestKeyBuffer(t *testing.T) {
+	key := newKeyBuffer(48)
+	if len(key) != 48 || cap(key) != 48 {
+		t.Fatal("Key buffer is", len(key), "bytes with capacity", cap(key))
+	}
+	for i := range key {
+		key[i] = byte(i + 1)
+	}
+	plain := []byte{1, 2, 3}
+	locked := lockKey(plain)
+	if string(locked) != "\x01\x02\x03" || string(plain) != "\x00\x00\x00" {
+		t.Error("lockKey did not move the key", locked, plain)
+	}
+	locked.wipe()
+	key.wipe()
+	newKeyBuffer(0).wipe()
+}
+
+func TestZeroKeyWrongLength(t *testing.T) {
+	// a key of the wrong length is logged, not panicked over, and is
+	// still zeroed
+	key := keyBuffer(make([]byte, 16))
+	for i := range key {
+		key[i] = 0xff
+	}
+	zeroKey(key, 32, "test key")
+	for _, b := range key {
+		if b != 0 {
+			t.Fatal("Key was not zeroed", key)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+/*
+
+Shamir secret sharing of the keys
+
+The keys, concatenated in secrets file order, are split byte by byte
+over GF(2^8) (with the AES polynomial x^8 + x^4 + x^3 + x + 1): each
+byte is the constant term of a random polynomial of degree K-1, and
+share X holds the polynomials evaluated at X.  Any K shares determine
+the polynomials, and hence the keys; fewer reveal nothing.
+
+Each share is armoured (see armor.go) as a "SHARE" block, with the
+headers Id (the secrets ID), Share (X of N) and Threshold (K).  The
+share data are:
+
+Byte Length
+  0    1    Version (0)
+  1    1    Threshold K
+  2    1    X
+  3   48    Secrets ID
+ 51  256    Share of the keys
+
+Combined keys are checked against the secrets ID, so that mismatched
+or corrupt shares are caught.
+
+*/
+
+// gfMul multiplies A and B in GF(2^8), without data-dependent branches
+func gfMul(a, b byte) (p byte) {
+	for i := 0; i < 8; i++ {
+		p ^= a & -(b & 1)
+		carry := -(a >> 7)
+		a = a<<1 ^ 0x1b&carry
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse of A, which is A^254
+func gfInv(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMul(a, a)
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+// splitBytes splits SECRET into N shares, any K of which suffice to
+// recover it.  Share i is evaluated at x = i+1.
+func splitBytes(secret []byte, n, k int) (shares [][]byte, err error) {
+	if k < 2 || n < k || n > 255 {
+		return nil, fmt.Errorf("Cannot split into %d shares with threshold %d", n, k)
+	}
+	coefficients, err := genKey(len(secret) * (k - 1))
+	if err != nil {
+		return nil, err
+	}
+	defer coefficients.wipe()
+	shares = make([][]byte, n)
+	for i := range shares {
+		x := byte(i + 1)
+		shares[i] = make([]byte, len(secret))
+		for j := range secret {
+			// Horner's rule, from the highest coefficient
+			var y byte
+			for c := k - 2; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[j*(k-1)+c]
+			}
+			shares[i][j] = gfMul(y, x) ^ secret[j]
+		}
+	}
+	return shares, nil
+}
+
+// combineBytes recovers a secret from SHARES, evaluated at XS, by
+// Lagrange interpolation at zero.
+func combineBytes(xs []byte, shares [][]byte) (secret []byte, err error) {
+	if len(xs) != len(shares) || len(shares) == 0 {
+		return nil, fmt.Errorf("No shares to combine")
+	}
+	seen := make(map[byte]bool)
+	for i, x := range xs {
+		if x == 0 || seen[x] {
+			return nil, fmt.Errorf("Duplicate or invalid share %d", x)
+		}
+		seen[x] = true
+		if len(shares[i]) != len(shares[0]) {
+			return nil, fmt.Errorf("Shares are of different lengths")
+		}
+	}
+	secret = make([]byte, len(shares[0]))
+	for i, xi := range xs {
+		// basis polynomial i at zero: product of xm / (xm - xi)
+		basis := byte(1)
+		for m, xm := range xs {
+			if m != i {
+				basis = gfMul(basis, gfMul(xm, gfInv(xm^xi)))
+			}
+		}
+		for j := range secret {
+			secret[j] ^= gfMul(shares[i][j], basis)
+		}
+	}
+	return secret, nil
+}
+
+// SplitSecrets writes N armoured shares of the keys in SECRETS to W,
+// any K of which can be combined to recover them.
+func SplitSecrets(secrets *Secrets, n, k int, w io.Writer) error {
+	keys := newKeyBuffer(secretsKeysLength())
+	defer keys.wipe()
+	offset := 0
+	for _, key := range secrets.keyFields() {
+		offset += copy(keys[offset:], *key)
+	}
+	shares, err := splitBytes(keys, n, k)
+	if err != nil {
+		return err
+	}
+	id := secrets.Id()
+	hexId := secrets.HexId()
+	for i, share := range shares {
+		data := []byte{0, byte(k), byte(i + 1)}
+		data = append(data, id...)
+		data = append(data, share...)
+		headers := [][2]string{{"Id", hexId},
+			{"Share", fmt.Sprintf("%d of %d", i+1, n)},
+			{"Threshold", strconv.Itoa(k)}}
+		err = writeArmor(w, "SHARE", headers, data)
+		zeroBytes(data)
+		zeroBytes(share)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// CombineShares reads armoured shares written by SplitSecrets from R
+// and recovers the keys from them.
+func CombineShares(r io.Reader) (secrets *Secrets, err error) {
+	scanner := bufio.NewScanner(r)
+	var xs []byte
+	var shares [][]byte
+	var id []byte
+	var threshold byte
+	defer func() {
+		for _, share := range shares {
+			zeroBytes(share)
+		}
+	}()
+	for {
+		data, _, err := readArmor(scanner, "SHARE")
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Share %d: %v", len(shares)+1, err)
+		}
+		if len(data) < 3+48 || data[0] != 0 {
+			return nil, fmt.Errorf("Share %d: unsupported share format", len(shares)+1)
+		}
+		if id == nil {
+			id = data[3:51]
+			threshold = data[1]
+		} else if !bytes.Equal(id, data[3:51]) {
+			return nil, fmt.Errorf("Share %d is for secrets %s, not %s", len(shares)+1, hex.EncodeToString(data[3:51]), hex.EncodeToString(id))
+		} else if threshold != data[1] {
+			return nil, fmt.Errorf("Share %d has threshold %d, not %d", len(shares)+1, data[1], threshold)
+		}
+		xs = append(xs, data[2])
+		shares = append(shares, data[51:])
+	}
+	if len(shares) < int(threshold) || len(shares) == 0 {
+		return nil, fmt.Errorf("Need %d shares, but have %d", threshold, len(shares))
+	}
+	keys, err := combineBytes(xs, shares)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(keys)
+	secrets = &Secrets{}
+	for i, key := range secrets.keyFields() {
+		if len(keys) < secretsKeyLengths[i] {
+			ZeroSecrets(secrets)
+			return nil, fmt.Errorf("Shares are too short")
+		}
+		*key = newKeyBuffer(secretsKeyLengths[i])
+		copy(*key, keys)
+		keys = keys[secretsKeyLengths[i]:]
+	}
+	if secrets.HexId() != hex.EncodeToString(id) {
+		ZeroSecrets(secrets)
+		return nil, fmt.Errorf("Combined keys do not match secrets %s: wrong or corrupt shares", hex.EncodeToString(id))
+	}
+	return secrets, nil
+}
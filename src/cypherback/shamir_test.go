@@ -0,0 +1,71 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGF256(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatal("Bad inverse of", a)
+		}
+	}
+}
+
+func TestSplitCombineSecrets(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored := &bytes.Buffer{}
+	err = SplitSecrets(secrets, 5, 3, armored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := strings.SplitAfter(armored.String(), "-----END CYPHERBACK SHARE-----\n")
+	// any three shares will do
+	combined, err := CombineShares(strings.NewReader(blocks[4] + blocks[0] + blocks[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ZeroSecrets(combined)
+	if combined.HexId() != secrets.HexId() {
+		t.Error("Combined secrets differ")
+	}
+	_, err = CombineShares(strings.NewReader(blocks[1] + blocks[3]))
+	if err == nil {
+		t.Error("Combined two shares of a threshold of three")
+	}
+
+	// a share from another split does not combine
+	other := &bytes.Buffer{}
+	err = SplitSecrets(secrets, 5, 3, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBlocks := strings.SplitAfter(other.String(), "-----END CYPHERBACK SHARE-----\n")
+	_, err = CombineShares(strings.NewReader(blocks[0] + blocks[1] + otherBlocks[2]))
+	if err == nil {
+		t.Error("Combined mismatched shares")
+	}
+}
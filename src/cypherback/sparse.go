@@ -0,0 +1,144 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+
+Sparse files
+
+A file with holes is recorded as a sparse file record (type 9): a
+regular file record with a map of the file's data extents before its
+chunks, which hold only the data in those extents, concatenated.  A
+file which is all hole has no extents and no chunks.  Restoring writes
+each extent's data at its offset and truncates the file to its size,
+so that the holes are recreated rather than filled with zeros.
+
+*/
+
+// An extent is a range of a sparse file which holds data
+type extent struct {
+	offset int64
+	length int64
+}
+
+// extentsLen returns the length of the map of EXTENTS, which is zero
+// for a file which is not sparse
+func extentsLen(extents []extent) uint64 {
+	if extents == nil {
+		return 0
+	}
+	return 8 + uint64(16*len(extents))
+}
+
+func writeExtents(writer io.Writer, extents []extent) {
+	binary.Write(writer, binary.BigEndian, uint64(len(extents)))
+	for _, extent := range extents {
+		binary.Write(writer, binary.BigEndian, extent.offset)
+		binary.Write(writer, binary.BigEndian, extent.length)
+	}
+}
+
+// readExtents reads the map of extents of a record of VERSION, whose
+// count is 64 bits wide from wideRecordVersion on
+func readExtents(reader io.Reader, version uint8) ([]extent, error) {
+	var count uint64
+	var err error
+	if version >= wideRecordVersion {
+		err = binary.Read(reader, binary.BigEndian, &count)
+	} else {
+		var narrowCount uint32
+		err = binary.Read(reader, binary.BigEndian, &narrowCount)
+		count = uint64(narrowCount)
+	}
+	if err != nil {
+		return nil, err
+	}
+	extents := make([]extent, 0)
+	for i := uint64(0); i < count; i++ {
+		var e extent
+		err = binary.Read(reader, binary.BigEndian, &e.offset)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(reader, binary.BigEndian, &e.length)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, e)
+	}
+	return extents, nil
+}
+
+func readSparseFile(reader io.Reader, version uint8) (fileRecord, error) {
+	return readFile(reader, true, version)
+}
+
+// dataReader returns a reader of the data in EXTENTS of FILE, or of
+// all SIZE bytes of FILE if it is not sparse.  It reads at offsets,
+// so it does not matter where finding the extents left the file's.
+func dataReader(file *os.File, size int64, extents []extent) io.Reader {
+	if extents == nil {
+		return io.NewSectionReader(file, 0, size)
+	}
+	readers := make([]io.Reader, len(extents))
+	for i, extent := range extents {
+		readers[i] = io.NewSectionReader(file, extent.offset, extent.length)
+	}
+	return io.MultiReader(readers...)
+}
+
+// An extentWriter writes the data of a sparse file, in order, into
+// its extents
+type extentWriter struct {
+	file    *os.File
+	extents []extent
+	// how much of the first extent has been written
+	written int64
+}
+
+func (w *extentWriter) Write(data []byte) (n int, err error) {
+	for len(data) > 0 {
+		if len(w.extents) == 0 {
+			return n, fmt.Errorf("%s has more data than its extents hold", w.file.Name())
+		}
+		extent := w.extents[0]
+		length := extent.length - w.written
+		if int64(len(data)) < length {
+			length = int64(len(data))
+		}
+		written, err := w.file.WriteAt(data[:length], extent.offset+w.written)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		data = data[length:]
+		w.written += length
+		if w.written == extent.length {
+			w.extents = w.extents[1:]
+			w.written = 0
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"os"
+	"syscall"
+)
+
+// lseek whences missing from package syscall
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// sparseExtents returns the data extents of FILE, described by INFO,
+// if it has holes, or nil if it has none or they cannot be found.
+// FILE is left at its start.
+func sparseExtents(file *os.File, info os.FileInfo) (extents []extent, err error) {
+	size := info.Size()
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Blocks*512 >= size {
+		// fully allocated, so there can be no holes
+		return nil, nil
+	}
+	defer func() {
+		_, seekErr := file.Seek(0, os.SEEK_SET)
+		if err == nil && seekErr != nil {
+			extents, err = nil, seekErr
+		}
+	}()
+	extents = make([]extent, 0)
+	for offset := int64(0); offset < size; {
+		start, err := file.Seek(offset, seekData)
+		if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENXIO {
+			// the rest of the file is a hole
+			break
+		}
+		if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EINVAL && offset == 0 {
+			// holes cannot be found on this filesystem
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := file.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+		if end > start {
+			extents = append(extents, extent{start, end - start})
+		}
+		offset = end
+	}
+	if len(extents) == 1 && extents[0].offset == 0 && extents[0].length == size {
+		return nil, nil
+	}
+	return extents, nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	memoryBackend "cypherback/backends/memory"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSparseFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const size = 8 << 20
+	sparsePath := filepath.Join(dir, "sparse")
+	holePath := filepath.Join(dir, "hole")
+	file, err := os.Create(sparsePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{1 << 20, size - 5} {
+		_, err = file.WriteAt([]byte("hello"), offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+	err = ioutil.WriteFile(holePath, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(holePath, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(sparsePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := memoryBackend.New()
+	set, err := EnsureBackupSet(backend, secrets, "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.StartBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ProcessPath(set, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.EndBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err = ReadBackupSet(backend, secrets, "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range set.records {
+		file, ok := record.(regularFileInfo)
+		if !ok {
+			continue
+		}
+		if file.extents == nil {
+			t.Skip("Holes cannot be found on this filesystem")
+		}
+		switch file.name {
+		case sparsePath:
+			if len(file.extents) != 2 || len(file.chunks) != 1 {
+				t.Error("Recorded extents", file.extents, "in", len(file.chunks), "chunks")
+			}
+		case holePath:
+			if len(file.extents) != 0 || len(file.chunks) != 0 {
+				t.Error("Recorded extents", file.extents, "in", len(file.chunks), "chunks")
+			}
+		}
+	}
+
+	// restoring over existing data must still leave holes
+	err = ioutil.WriteFile(sparsePath, bytes.Repeat([]byte{1}, size), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(holePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RestoreBackupSet(backend, secrets, "sparse", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ioutil.ReadFile(sparsePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, contents) {
+		t.Error("Restored sparse file differs")
+	}
+	for _, path := range []string{sparsePath, holePath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != size || info.Sys().(*syscall.Stat_t).Blocks*512 >= size {
+			t.Error(path, "restored with size", info.Size(), "and", info.Sys().(*syscall.Stat_t).Blocks, "blocks")
+		}
+	}
+}
+
+// blocklessInfo describes a file as having no blocks allocated, as a
+// compressing filesystem or one which stores small files inline may
+type blocklessInfo struct {
+	os.FileInfo
+	stat syscall.Stat_t
+}
+
+func (i blocklessInfo) Sys() interface{} {
+	return &i.stat
+}
+
+func TestUnallocatedFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	contents := bytes.Repeat([]byte("0123456789"), 10000)
+	_, err = file.Write(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := blocklessInfo{info, *info.Sys().(*syscall.Stat_t)}
+	fake.stat.Blocks = 0
+	_, err = file.Seek(0, os.SEEK_SET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file with no holes is not sparse, however few blocks it has
+	extents, err := sparseExtents(file, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extents != nil {
+		t.Error("Found extents", extents)
+	}
+	data, err := ioutil.ReadAll(dataReader(file, fake.Size(), extents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, contents) {
+		t.Error("Read", len(data), "of", len(contents), "bytes")
+	}
+
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := newBackupSet("unallocated", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(set.tempDir)
+	record, err := set.newRegularFileInfo(file.Name(), fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.extents != nil || len(record.chunks) != 1 {
+		t.Error("Recorded extents", record.extents, "in", len(record.chunks), "chunks")
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// A recordFunc is called with each record of a backup set, in order
+type recordFunc func(record fileRecord) error
+
+// segmentReader decrypts the segments of a version 3 or later backup
+// set as they are needed, so that only one is decrypted at a time
+type segmentReader struct {
+	source    io.Reader
+	aead      cipher.AEAD
+	iv        []byte
+	header    []byte
+	count     uint32
+	plaintext []byte
+}
+
+func (r *segmentReader) Read(buf []byte) (n int, err error) {
+	for len(r.plaintext) == 0 {
+		var length uint32
+		err = binary.Read(r.source, binary.BigEndian, &length)
+		if err == io.EOF && r.count > 0 {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Truncated segment %d", r.count)
+		}
+		sealed := make([]byte, length)
+		_, err = io.ReadFull(r.source, sealed)
+		if err != nil {
+			return 0, fmt.Errorf("Truncated segment %d", r.count)
+		}
+		padded, err := r.aead.Open(nil, segmentNonce(r.iv, r.count), sealed, segmentData(r.header, r.count))
+		if err != nil {
+			return 0, fmt.Errorf("Segment %d: %v", r.count, err)
+		}
+		r.plaintext, err = unpadPlaintext(padded)
+		if err != nil {
+			return 0, fmt.Errorf("Segment %d: %v", r.count, err)
+		}
+		r.count++
+	}
+	n = copy(buf, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+// readSetHeader reads the tag, generation if the set has one and
+// early-exit HMAC which begin a backup set's plaintext from READER,
+// returning the tag and generation once the HMAC, which also covers
+// HEADER (the version and nonce) and the KEY and IV, has been checked
+func readSetHeader(reader io.Reader, secrets *Secrets, header, key, iv []byte) (tag string, generation uint64, err error) {
+	exitEarlyDigester := hmac.New(sha512.New384, secrets.metadataAuthentication)
+	exitEarlyDigester.Write(header)
+	exitEarlyDigester.Write(key)
+	exitEarlyDigester.Write(iv)
+	var tagLen uint32
+	err = binary.Read(reader, binary.BigEndian, &tagLen)
+	if err != nil {
+		return "", 0, err
+	}
+	binary.Write(exitEarlyDigester, binary.BigEndian, tagLen)
+	tagBytes := make([]byte, tagLen)
+	_, err = io.ReadFull(reader, tagBytes)
+	if err != nil {
+		return "", 0, err
+	}
+	exitEarlyDigester.Write(tagBytes)
+	if header[0] >= generationVersion {
+		err = binary.Read(reader, binary.BigEndian, &generation)
+		if err != nil {
+			return "", 0, err
+		}
+		binary.Write(exitEarlyDigester, binary.BigEndian, generation)
+	}
+	exitEarlySum := make([]byte, 48)
+	_, err = io.ReadFull(reader, exitEarlySum)
+	if err != nil {
+		return "", 0, err
+	}
+	if !hmac.Equal(exitEarlySum, exitEarlyDigester.Sum(nil)) {
+		return "", 0, fmt.Errorf("Error decoding backup set")
+	}
+	return string(tagBytes), generation, nil
+}
+
+// streamBackupSet decodes the backup set in SOURCE, calling FN with
+// each of its records as it is decrypted rather than holding them all.
+// SOURCE is read twice: first to check the set's HMAC, so that FN is
+// never given unauthenticated records, and then to decrypt it, at the
+// end of which the HMAC is checked again in case SOURCE changed.  A
+// set with an index of runs is returned with the index, and FN is not
+// called.  A set older than one seen before fails with a
+// StaleMetadataError.
+func streamBackupSet(secrets *Secrets, source io.ReadSeeker, fn recordFunc) (*BackupSet, error) {
+	length, err := source.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+	authLength := length - sha512.Size384
+	if authLength < 1+48 {
+		return nil, fmt.Errorf("Error decoding backup set: %d bytes long", length)
+	}
+	_, err = source.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return nil, err
+	}
+	digester := hmac.New(sha512.New384, secrets.metadataAuthentication)
+	_, err = io.CopyN(digester, source, authLength)
+	if err != nil {
+		return nil, err
+	}
+	authTag := make([]byte, sha512.Size384)
+	_, err = io.ReadFull(source, authTag)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(authTag, digester.Sum(nil)) {
+		return nil, fmt.Errorf("Error decoding backup set: invalid authentication tag")
+	}
+
+	_, err = source.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return nil, err
+	}
+	digester.Reset()
+	reader := io.TeeReader(io.LimitReader(source, authLength), digester)
+	header := make([]byte, 1+48)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	version := header[0]
+	if !validSetVersion(version) {
+		return nil, fmt.Errorf("Unsupported file version %d", version)
+	}
+	keyMat := nistConcatKDF(secrets.metadataMaster, []byte("metadata encryption"), header[1:], 48)
+	defer keyMat.wipe()
+	key := keyMat[0:32]
+	iv := keyMat[32:48]
+	aesCypher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	var plaintext io.Reader
+	var segments *segmentReader
+	if version == ctrVersion {
+		plaintext = cipher.StreamReader{S: cipher.NewCTR(aesCypher, iv), R: reader}
+	} else {
+		aead, err := cipher.NewGCM(aesCypher)
+		if err != nil {
+			return nil, err
+		}
+		if version >= segmentedVersion {
+			segments = &segmentReader{source: reader, aead: aead, iv: iv, header: header}
+			plaintext = segments
+		} else {
+			// GCM cannot release any plaintext until it has seen
+			// the whole set
+			sealed, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+			opened, err := aead.Open(nil, iv[:aead.NonceSize()], sealed, header)
+			if err != nil {
+				return nil, fmt.Errorf("Error decoding backup set: %v", err)
+			}
+			if version == paddedVersion {
+				opened, err = unpadPlaintext(opened)
+				if err != nil {
+					return nil, fmt.Errorf("Error decoding backup set: %v", err)
+				}
+			}
+			plaintext = bytes.NewReader(opened)
+		}
+	}
+	b, err := newBackupSet("", secrets)
+	if err != nil {
+		return nil, err
+	}
+	b.tag, b.generation, err = readSetHeader(plaintext, secrets, header, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	if version >= indexedVersion {
+		var index []byte
+		index, err = ioutil.ReadAll(plaintext)
+		if err == nil {
+			b.runs, err = readRunIndex(bytes.NewReader(index), uint64(len(index)))
+		}
+	} else {
+		err = streamRecords(plaintext, fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if segments != nil {
+		b.segments = segments.count
+	}
+	if version >= generationVersion {
+		// each segment appended bumps the generation
+		b.generation += uint64(b.segments) - 1
+	}
+	_, err = io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(authTag, digester.Sum(nil)) {
+		return nil, fmt.Errorf("Error decoding backup set: it changed while being read")
+	}
+	err = generationCache.check(secrets.HexId(), tagToId(secrets, b.tag), b.generation)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// streamRecords reads records from READER until it is exhausted,
+// calling FN with each
+func streamRecords(reader io.Reader, fn recordFunc) error {
+	lastWasEnd := true
+	for {
+		var record fileRecord
+		var version uint8
+		var recordType uint8
+		err := binary.Read(reader, binary.BigEndian, &version)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if version > maxRecordVersion {
+			return fmt.Errorf("Error decoding backup set: unknown version %d", version)
+		}
+		err = binary.Read(reader, binary.BigEndian, &recordType)
+		if err != nil {
+			return err
+		}
+		switch recordType {
+		case 0:
+			if !lastWasEnd {
+				return fmt.Errorf("Error decoding backup set: unexpected start record")
+			}
+			record, err = readStartRecord(reader, version)
+			lastWasEnd = false
+		case 1:
+			record, err = readHardLink(reader)
+		case 2:
+			record, err = readDirectory(reader)
+		case 3:
+			record, err = readRegularFile(reader, version)
+		case 4:
+			record, err = readFifo(reader)
+		case 5:
+			record, err = readSymLink(reader)
+		case 6, 7:
+			if version < deviceRecordVersion {
+				return fmt.Errorf("Error decoding backup set: device record of version %d lacks its file header", version)
+			}
+			if recordType == 6 {
+				record, err = readCharDevice(reader)
+			} else {
+				record, err = readBlockDevice(reader)
+			}
+		case 8:
+			record, err = readEndRecord(reader)
+			lastWasEnd = true
+		case 9:
+			record, err = readSparseFile(reader, version)
+		case 10:
+			record, err = readErrorRecord(reader)
+		default:
+			return fmt.Errorf("Error decoding backup set: unsupported type %d", recordType)
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if record == nil {
+			return fmt.Errorf("Error decoding backup set: truncated record")
+		}
+		if version&xattrRecordFlag != 0 {
+			xattrs, err := readXattrs(reader)
+			if err != nil {
+				return err
+			}
+			record, err = withXattrs(record, xattrs)
+			if err != nil {
+				return err
+			}
+		}
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// walkBackupSet calls FN with each record of the COUNT most recent
+// runs, or all runs if COUNT is zero, of the backup set tagged TAG.
+// Sets which predate indices are always read whole.  Each object is
+// authenticated in full before any of its records are passed to FN.
+// Backends hand over objects whole, so the set's index and then each
+// run in turn are held in memory, both sealed and decrypted; only the
+// decoded records of different runs are never held together.
+func walkBackupSet(backend Backend, secrets *Secrets, tag string, count int, fn recordFunc) error {
+	data, err := backend.ReadBackupSet(secrets.HexId(), tagToId(secrets, tag))
+	if os.IsNotExist(err) {
+		return NoSuchBackupSet
+	}
+	if err != nil {
+		return err
+	}
+	b, err := streamBackupSet(secrets, bytes.NewReader(data), fn)
+	if err != nil {
+		return err
+	}
+	if b.tag != tag {
+		return fmt.Errorf("Backup set %s holds the set tagged %q", tag, b.tag)
+	}
+	runs := b.runs
+	if count > 0 && count < len(runs) {
+		runs = runs[len(runs)-count:]
+	}
+	for _, run := range runs {
+		err = b.streamRun(backend, run, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListBackupSet writes a listing of the COUNT most recent runs, or all
+// runs if COUNT is zero, of the backup set tagged TAG to W, one run at
+// a time (see walkBackupSet).
+func ListBackupSet(backend Backend, secrets *Secrets, tag string, count int, w io.Writer) error {
+	return walkBackupSet(backend, secrets, tag, count, func(record fileRecord) error {
+		listRecord(w, record)
+		return nil
+	})
+}
+
+// RestoreBackupSet restores every run of the backup set tagged TAG as
+// OPTIONS, which may be nil for the defaults, direct, one run at a
+// time (see walkBackupSet).
+func RestoreBackupSet(backend Backend, secrets *Secrets, tag string, options *RestoreOptions) error {
+	restorer := newRestorer(backend, secrets, options)
+	err := walkBackupSet(backend, secrets, tag, 0, func(record fileRecord) error {
+		return record.Restore(restorer)
+	})
+	if err != nil {
+		return err
+	}
+	return restorer.finish()
+}
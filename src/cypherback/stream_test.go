@@ -0,0 +1,124 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	memoryBackend "cypherback/backends/memory"
+	"os"
+	"strings"
+	"testing"
+)
+
+// changingReader flips a byte of its data when it is rewound for the
+// second time, as a backend might if it changed between reads
+type changingReader struct {
+	*bytes.Reader
+	data    []byte
+	rewinds int
+}
+
+func (r *changingReader) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == os.SEEK_SET {
+		r.rewinds++
+		if r.rewinds == 2 {
+			r.data[len(r.data)/2] ^= 1
+		}
+	}
+	return r.Reader.Seek(offset, whence)
+}
+
+func TestStreamBackupSet(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := newBackupSet("foo", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRun(t, set, "/tmp/first")
+	addRun(t, set, "/tmp/second")
+	for _, version := range []uint8{ctrVersion, gcmVersion, paddedVersion, segmentedVersion} {
+		data, err := set.encodeVersion(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed := 0
+		_, err = streamBackupSet(secrets, bytes.NewReader(data), func(record fileRecord) error {
+			streamed++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(version, err)
+		}
+		if streamed != len(set.records) {
+			t.Error("Streamed", streamed, "records from a version", version, "backup set")
+		}
+
+		// nothing unauthenticated is ever passed on
+		data[len(data)/2] ^= 1
+		_, err = streamBackupSet(secrets, bytes.NewReader(data), func(record fileRecord) error {
+			t.Error("Streamed a record from a corrupt version", version, "backup set")
+			return nil
+		})
+		if err == nil {
+			t.Error("Streamed a corrupt version", version, "backup set")
+		}
+		data[len(data)/2] ^= 1
+
+		_, err = streamBackupSet(secrets, &changingReader{Reader: bytes.NewReader(data), data: data}, func(fileRecord) error {
+			return nil
+		})
+		if err == nil {
+			t.Error("Streamed a version", version, "backup set which changed while being read")
+		}
+	}
+}
+
+func TestListBackupSet(t *testing.T) {
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := memoryBackend.New()
+	set, err := EnsureBackupSet(backend, secrets, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRun(t, set, "/tmp/first")
+	addRun(t, set, "/tmp/second")
+	err = set.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := &bytes.Buffer{}
+	err = ListBackupSet(backend, secrets, "foo", 1, listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(listing.String(), "/tmp/first") || !strings.Contains(listing.String(), "/tmp/second") {
+		t.Error("Listed", listing.String())
+	}
+	err = ListBackupSet(backend, secrets, "bar", 0, os.Stdout)
+	if err != NoSuchBackupSet {
+		t.Error("Listed a missing backup set:", err)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+
+Extended attributes
+
+A file record whose file has extended attributes (including POSIX ACLs,
+as system.posix_acl_access and system.posix_acl_default, and file
+capabilities, as security.capability) is written with
+xattrRecordFlag set in its version: its usual data is followed by an
+attribute section of
+
+Length
+   4    number of attributes
+   -    attributes, each:
+          4    name length
+          -    name
+          4    value length
+          -    value
+
+Records without attributes are written without the flag or section.
+
+*/
+
+type xattr struct {
+	name  string
+	value []byte
+}
+
+// An xattrRecord is a file record which may carry extended attributes
+type xattrRecord interface {
+	extendedAttributes() []xattr
+}
+
+// An xattrSetter is a file record being built, to which attributes
+// may be added
+type xattrSetter interface {
+	setExtendedAttributes(xattrs []xattr)
+}
+
+func (r baseFileInfo) extendedAttributes() []xattr {
+	return r.xattrs
+}
+
+func (r *baseFileInfo) setExtendedAttributes(xattrs []xattr) {
+	r.xattrs = xattrs
+}
+
+// xattrsLen returns the length of the attribute section for XATTRS,
+// which is zero if there are none
+func xattrsLen(xattrs []xattr) uint64 {
+	if len(xattrs) == 0 {
+		return 0
+	}
+	length := uint64(4)
+	for _, xattr := range xattrs {
+		length += 4 + uint64(len(xattr.name)) + 4 + uint64(len(xattr.value))
+	}
+	return length
+}
+
+// encodeRecord returns the version, type and data of RECORD, with its
+// attribute section, if any, appended
+func encodeRecord(record fileRecord) (version, recordType uint8, data []byte, err error) {
+	recordType, data, err = record.Record()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	withXattrs, ok := record.(xattrRecord)
+	if !ok || len(withXattrs.extendedAttributes()) == 0 {
+		return currentRecordVersion, recordType, data, nil
+	}
+	writer := bytes.NewBuffer(data)
+	xattrs := withXattrs.extendedAttributes()
+	binary.Write(writer, binary.BigEndian, uint32(len(xattrs)))
+	for _, xattr := range xattrs {
+		binary.Write(writer, binary.BigEndian, uint32(len(xattr.name)))
+		writer.WriteString(xattr.name)
+		binary.Write(writer, binary.BigEndian, uint32(len(xattr.value)))
+		writer.Write(xattr.value)
+	}
+	return currentRecordVersion | xattrRecordFlag, recordType, writer.Bytes(), nil
+}
+
+// readXattrs reads an attribute section from READER
+func readXattrs(reader io.Reader) (xattrs []xattr, err error) {
+	var count uint32
+	err = binary.Read(reader, binary.BigEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < count; i++ {
+		var nameLen, valueLen uint32
+		err = binary.Read(reader, binary.BigEndian, &nameLen)
+		if err != nil {
+			return nil, err
+		}
+		name, err := readLenString(reader, nameLen)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(reader, binary.BigEndian, &valueLen)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueLen)
+		_, err = io.ReadFull(reader, value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs = append(xattrs, xattr{name, value})
+	}
+	return xattrs, nil
+}
+
+// withXattrs returns the decoded RECORD carrying XATTRS
+func withXattrs(record fileRecord, xattrs []xattr) (fileRecord, error) {
+	switch r := record.(type) {
+	case directoryInfo:
+		r.xattrs = xattrs
+		return r, nil
+	case regularFileInfo:
+		r.xattrs = xattrs
+		return r, nil
+	case fifoInfo:
+		r.xattrs = xattrs
+		return r, nil
+	case symLinkInfo:
+		r.xattrs = xattrs
+		return r, nil
+	case charDeviceInfo:
+		r.xattrs = xattrs
+		return r, nil
+	case blockDeviceInfo:
+		r.xattrs = xattrs
+		return r, nil
+	}
+	return nil, fmt.Errorf("Error decoding backup set: %T record cannot have extended attributes", record)
+}
+
+// An xattrFilter selects the extended attributes backed up by
+// namespace, such as "user", or by name, such as
+// "security.capability".  An empty include list includes everything.
+type xattrFilter struct {
+	include []string
+	exclude []string
+}
+
+// matchXattr reports whether NAME is PATTERN or lies within it
+func matchXattr(pattern, name string) bool {
+	return name == pattern || strings.HasPrefix(name, pattern+".")
+}
+
+func (f xattrFilter) wanted(name string) bool {
+	for _, pattern := range f.exclude {
+		if matchXattr(pattern, name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if matchXattr(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseXattrPatterns splits the comma-separated LIST of namespaces and
+// names
+func parseXattrPatterns(list string) (patterns []string, err error) {
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if strings.HasPrefix(pattern, ".") || strings.HasSuffix(pattern, ".") {
+			return nil, fmt.Errorf("Invalid extended attribute pattern %q", pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// SetXattrFilter limits the extended attributes backed up to those in
+// the namespaces or with the names in the comma-separated INCLUDE, or
+// all if it is empty, less those in EXCLUDE.
+func (b *BackupSet) SetXattrFilter(include, exclude string) (err error) {
+	var filter xattrFilter
+	filter.include, err = parseXattrPatterns(include)
+	if err != nil {
+		return err
+	}
+	filter.exclude, err = parseXattrPatterns(exclude)
+	if err != nil {
+		return err
+	}
+	b.xattrFilter = filter
+	return nil
+}
+
+// readXattrs returns the extended attributes of PATH which B's filter
+// selects
+func (b *BackupSet) readXattrs(path string) ([]xattr, error) {
+	names, err := listXattrs(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list extended attributes of %s: %v", path, err)
+	}
+	var xattrs []xattr
+	for _, name := range names {
+		if !b.xattrFilter.wanted(name) {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read extended attribute %s of %s: %v", name, path, err)
+		}
+		xattrs = append(xattrs, xattr{name, value})
+	}
+	return xattrs, nil
+}
+
+// restoreXattrs sets XATTRS on PATH, returning an error for each which
+// could not be set.  Attributes which the filesystem does not support,
+// or which only a privileged user may set, are skipped, but still
+// reported, so that a restore without them is not mistaken for a
+// complete one.
+func restoreXattrs(path string, xattrs []xattr) (errs []error) {
+	for _, xattr := range xattrs {
+		err := setXattr(path, xattr.name, xattr.value)
+		switch {
+		case err == nil:
+		case xattrUnsettable(err):
+			errs = append(errs, fmt.Errorf("Skipped extended attribute %s, which cannot be set here: %v", xattr.name, err))
+		default:
+			errs = append(errs, fmt.Errorf("Cannot set extended attribute %s: %v", xattr.name, err))
+		}
+	}
+	return errs
+}
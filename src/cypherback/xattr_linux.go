@@ -0,0 +1,123 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	"bytes"
+	"syscall"
+	"unsafe"
+)
+
+// The l variants of the xattr calls, which do not follow symlinks, are
+// missing from package syscall.
+
+func lxattrCall(trap uintptr, path, name string, buf []byte, flags int) (int, error) {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var namePtr *byte
+	if name != "" {
+		namePtr, err = syscall.BytePtrFromString(name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var bufPtr unsafe.Pointer
+	if len(buf) > 0 {
+		bufPtr = unsafe.Pointer(&buf[0])
+	}
+	var r uintptr
+	var errno syscall.Errno
+	if trap == syscall.SYS_LLISTXATTR {
+		r, _, errno = syscall.Syscall(trap, uintptr(unsafe.Pointer(pathPtr)), uintptr(bufPtr), uintptr(len(buf)))
+	} else {
+		r, _, errno = syscall.Syscall6(trap, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(namePtr)), uintptr(bufPtr), uintptr(len(buf)), uintptr(flags), 0)
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+// listXattrs returns the names of the extended attributes of PATH,
+// without following a final symlink
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := lxattrCall(syscall.SYS_LLISTXATTR, path, "", nil, 0)
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		size, err = lxattrCall(syscall.SYS_LLISTXATTR, path, "", buf, 0)
+		if err == syscall.ERANGE {
+			// attributes were added in between
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// getXattr returns the value of the extended attribute NAME of PATH
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := lxattrCall(syscall.SYS_LGETXATTR, path, name, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size == 0 {
+			return value, nil
+		}
+		size, err = lxattrCall(syscall.SYS_LGETXATTR, path, name, value, 0)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	}
+}
+
+// setXattr sets the extended attribute NAME of PATH to VALUE
+func setXattr(path, name string, value []byte) error {
+	_, err := lxattrCall(syscall.SYS_LSETXATTR, path, name, value, 0)
+	return err
+}
+
+// xattrUnsettable reports whether ERR means that an attribute cannot
+// be set here at all, rather than that setting it failed
+func xattrUnsettable(err error) bool {
+	return err == syscall.ENOTSUP || err == syscall.EPERM
+}
@@ -0,0 +1,173 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+//
+// This file is part of cypherback.
+//
+// Cypherback is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Cypherback is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Cypherback.  If not, see <http://www.gnu.org/licenses/>.
+
+package cypherback
+
+import (
+	memoryBackend "cypherback/backends/memory"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestXattrFilter(t *testing.T) {
+	set := &BackupSet{}
+	err := set.SetXattrFilter("user, security.capability", "user.private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, wanted := range map[string]bool{
+		"user.comment":            true,
+		"user.private":            false,
+		"user.private.key":        false,
+		"user.privateer":          true,
+		"security.capability":     true,
+		"security.selinux":        false,
+		"system.posix_acl_access": false,
+	} {
+		if set.xattrFilter.wanted(name) != wanted {
+			t.Error("Filter wants", name, !wanted)
+		}
+	}
+	if set.SetXattrFilter("user.", "") == nil {
+		t.Error("Accepted an invalid pattern")
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Extended attributes are only supported on Linux")
+	}
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(path, []byte("some file contents"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setXattr(path, "user.keep", []byte("kept"))
+	if err != nil {
+		t.Skip("Extended attributes are not supported here:", err)
+	}
+	err = setXattr(path, "user.skip", []byte("skipped"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := generateSecrets()
+	defer ZeroSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := memoryBackend.New()
+	set, err := EnsureBackupSet(backend, secrets, "xattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.SetXattrFilter("", "user.skip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.StartBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ProcessPath(set, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.EndBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.Write(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err = ReadBackupSet(backend, secrets, "xattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, record := range set.records {
+		file, ok := record.(regularFileInfo)
+		if !ok {
+			continue
+		}
+		found = true
+		if len(file.xattrs) != 1 || file.xattrs[0].name != "user.keep" || string(file.xattrs[0].value) != "kept" {
+			t.Error("Read extended attributes", file.xattrs)
+		}
+	}
+	if !found {
+		t.Fatal("The file was not backed up")
+	}
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RestoreBackupSet(backend, secrets, "xattrs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := getXattr(path, "user.keep")
+	if err != nil || string(value) != "kept" {
+		t.Error("Restored user.keep as", string(value), err)
+	}
+	_, err = getXattr(path, "user.skip")
+	if err == nil {
+		t.Error("Restored an excluded attribute")
+	}
+}
+
+func TestRestoreXattrsReported(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Extended attributes are only supported on Linux")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("Root may set trusted attributes")
+	}
+	dir, err := ioutil.TempDir("", "cypherback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(path, []byte("some file contents"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setXattr(path, "user.test", []byte("test")) != nil {
+		t.Skip("Extended attributes are not supported here")
+	}
+	errs := restoreXattrs(path, []xattr{
+		{"trusted.cypherback", []byte("privileged")},
+		{"user.keep", []byte("kept")},
+	})
+	if len(errs) != 1 {
+		t.Error("Restoring reported", errs)
+	}
+	value, err := getXattr(path, "user.keep")
+	if err != nil || string(value) != "kept" {
+		t.Error("Restored user.keep as", string(value), err)
+	}
+}